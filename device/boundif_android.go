@@ -8,7 +8,7 @@ package device
 import "errors"
 
 func (device *Device) PeekLookAtSocketFd4() (fd int, err error) {
-	nb, ok := device.net.bind.(*nativeBind)
+	nb, ok := device.unsafeNativeBind()
 	if !ok {
 		return 0, errors.New("no socket exists")
 	}
@@ -26,7 +26,7 @@ func (device *Device) PeekLookAtSocketFd4() (fd int, err error) {
 }
 
 func (device *Device) PeekLookAtSocketFd6() (fd int, err error) {
-	nb, ok := device.net.bind.(*nativeBind)
+	nb, ok := device.unsafeNativeBind()
 	if !ok {
 		return 0, errors.New("no socket exists")
 	}
@@ -24,11 +24,12 @@ func (device *Device) BindSocketToInterface4(interfaceIndex uint32, blackhole bo
 	binary.BigEndian.PutUint32(bytes, interfaceIndex)
 	interfaceIndex = *(*uint32)(unsafe.Pointer(&bytes[0]))
 
-	if device.net.bind == nil {
+	nb, ok := device.unsafeNativeBind()
+	if !ok || nb.ipv4 == nil {
 		return errors.New("Bind is not yet initialized")
 	}
 
-	sysconn, err := device.net.bind.(*nativeBind).ipv4.SyscallConn()
+	sysconn, err := nb.ipv4.SyscallConn()
 	if err != nil {
 		return err
 	}
@@ -41,12 +42,17 @@ func (device *Device) BindSocketToInterface4(interfaceIndex uint32, blackhole bo
 	if err != nil {
 		return err
 	}
-	device.net.bind.(*nativeBind).blackhole4 = blackhole
+	nb.blackhole4 = blackhole
 	return nil
 }
 
 func (device *Device) BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error {
-	sysconn, err := device.net.bind.(*nativeBind).ipv6.SyscallConn()
+	nb, ok := device.unsafeNativeBind()
+	if !ok || nb.ipv6 == nil {
+		return errors.New("Bind is not yet initialized")
+	}
+
+	sysconn, err := nb.ipv6.SyscallConn()
 	if err != nil {
 		return err
 	}
@@ -59,6 +65,6 @@ func (device *Device) BindSocketToInterface6(interfaceIndex uint32, blackhole bo
 	if err != nil {
 		return err
 	}
-	device.net.bind.(*nativeBind).blackhole6 = blackhole
+	nb.blackhole6 = blackhole
 	return nil
 }
@@ -0,0 +1,293 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+/* Captures the cleartext packets traversing the tunnel to a pcapng file,
+ * for debugging the applications inside of the tunnel.
+ *
+ * Outbound packets are captured after routing (before encryption),
+ * inbound packets after the source has been verified (before writing to the TUN device).
+ * The comment of every packet records the public key of the related peer.
+ *
+ * The file must not exist yet, so that a capture cannot overwrite other files.
+ * Packets are buffered, the buffer is flushed every CaptureFlushInterval and when the capture stops.
+ */
+
+const (
+	pcapngBlockSectionHeader       = 0x0a0d0d0a
+	pcapngBlockInterfaceDescriptor = 0x00000001
+	pcapngBlockEnhancedPacket      = 0x00000006
+	pcapngByteOrderMagic           = 0x1a2b3c4d
+	pcapngLinkTypeRaw              = 101 // raw IPv4 / IPv6
+	pcapngOptionEnd                = 0
+	pcapngOptionComment            = 1
+	pcapngOptionInterfaceName      = 2
+	pcapngOptionPacketFlags        = 2
+	pcapngFlagInbound              = 1
+	pcapngFlagOutbound             = 2
+)
+
+const (
+	captureInbound = iota
+	captureOutbound
+)
+
+type pcapngWriter struct {
+	writer  io.Writer
+	written int64
+	block   []byte
+}
+
+func pcapngPad(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (w *pcapngWriter) appendUint16(v uint16) {
+	w.block = append(w.block, 0, 0)
+	binary.LittleEndian.PutUint16(w.block[len(w.block)-2:], v)
+}
+
+func (w *pcapngWriter) appendUint32(v uint32) {
+	w.block = append(w.block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(w.block[len(w.block)-4:], v)
+}
+
+func (w *pcapngWriter) appendPadded(data []byte) {
+	w.block = append(w.block, data...)
+	for i := len(data); i < pcapngPad(len(data)); i++ {
+		w.block = append(w.block, 0)
+	}
+}
+
+func (w *pcapngWriter) appendOption(code uint16, value []byte) {
+	w.appendUint16(code)
+	w.appendUint16(uint16(len(value)))
+	w.appendPadded(value)
+}
+
+func (w *pcapngWriter) beginBlock(blockType uint32) {
+	w.block = w.block[:0]
+	w.appendUint32(blockType)
+	w.appendUint32(0) // total length, filled in by finishBlock
+}
+
+/* Returns the size of the block in progress once finished
+ */
+func (w *pcapngWriter) finishedSize() int64 {
+	return int64(len(w.block) + 4)
+}
+
+func (w *pcapngWriter) finishBlock() error {
+	length := uint32(w.finishedSize())
+	binary.LittleEndian.PutUint32(w.block[4:8], length)
+	w.appendUint32(length)
+	n, err := w.writer.Write(w.block)
+	w.written += int64(n)
+	return err
+}
+
+func newPcapngWriter(writer io.Writer) (*pcapngWriter, error) {
+	w := &pcapngWriter{
+		writer: writer,
+		block:  make([]byte, 0, 256),
+	}
+
+	// section header
+
+	w.beginBlock(pcapngBlockSectionHeader)
+	w.appendUint32(pcapngByteOrderMagic)
+	w.appendUint16(1) // major version
+	w.appendUint16(0) // minor version
+	w.appendUint32(0xffffffff)
+	w.appendUint32(0xffffffff) // section length unspecified
+	w.appendUint32(pcapngOptionEnd)
+	if err := w.finishBlock(); err != nil {
+		return nil, err
+	}
+
+	// single interface carrying raw IP packets
+
+	w.beginBlock(pcapngBlockInterfaceDescriptor)
+	w.appendUint16(pcapngLinkTypeRaw)
+	w.appendUint16(0) // reserved
+	w.appendUint32(0) // no snapshot length limit
+	w.appendOption(pcapngOptionInterfaceName, []byte("wireguard"))
+	w.appendUint32(pcapngOptionEnd)
+	if err := w.finishBlock(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+/* Prepares an enhanced packet block,
+ * which is written by a subsequent call to finishBlock
+ */
+func (w *pcapngWriter) preparePacket(packet []byte, timestamp time.Time, direction int, comment string) {
+	micros := uint64(timestamp.UnixNano() / int64(time.Microsecond))
+	w.beginBlock(pcapngBlockEnhancedPacket)
+	w.appendUint32(0) // interface id
+	w.appendUint32(uint32(micros >> 32))
+	w.appendUint32(uint32(micros))
+	w.appendUint32(uint32(len(packet))) // captured length
+	w.appendUint32(uint32(len(packet))) // original length
+	w.appendPadded(packet)
+
+	var flags [4]byte
+	if direction == captureInbound {
+		binary.LittleEndian.PutUint32(flags[:], pcapngFlagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags[:], pcapngFlagOutbound)
+	}
+	w.appendOption(pcapngOptionPacketFlags, flags[:])
+	if comment != "" {
+		w.appendOption(pcapngOptionComment, []byte(comment))
+	}
+	w.appendUint32(pcapngOptionEnd)
+}
+
+func (device *Device) StartCapture(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriterSize(file, CaptureBufferSize)
+	writer, err := newPcapngWriter(buffered)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	device.capture.Lock()
+	defer device.capture.Unlock()
+
+	device.unsafeStopCapture()
+	device.capture.file = file
+	device.capture.path = path
+	device.capture.buffered = buffered
+	device.capture.writer = writer
+	device.capture.stop = make(chan struct{})
+	device.capture.enabled.Set(true)
+	go device.routineFlushCapture(writer, device.capture.stop)
+
+	device.log.Info.Println("Capturing cleartext packets to", path)
+	return nil
+}
+
+func (device *Device) StopCapture() error {
+	device.capture.Lock()
+	defer device.capture.Unlock()
+	return device.unsafeStopCapture()
+}
+
+/* Must hold device.capture.Mutex
+ */
+func (device *Device) unsafeStopCapture() error {
+	device.capture.enabled.Set(false)
+	if device.capture.file == nil {
+		return nil
+	}
+	close(device.capture.stop)
+	err := device.capture.buffered.Flush()
+	if closeErr := device.capture.file.Close(); err == nil {
+		err = closeErr
+	}
+	device.log.Info.Println("Stopped capturing packets to", device.capture.path)
+	device.capture.file = nil
+	device.capture.buffered = nil
+	device.capture.writer = nil
+	device.capture.stop = nil
+	device.capture.path = ""
+	return err
+}
+
+/* Flushes the buffered packets of the capture periodically, until it stops
+ */
+func (device *Device) routineFlushCapture(writer *pcapngWriter, stop chan struct{}) {
+	ticker := time.NewTicker(CaptureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		device.capture.Lock()
+		if device.capture.writer == writer {
+			if err := device.capture.buffered.Flush(); err != nil {
+				device.log.Error.Println("Failed to write captured packets:", err)
+				device.unsafeStopCapture()
+			}
+		}
+		device.capture.Unlock()
+	}
+}
+
+/* Restricts the capture to a single peer,
+ * nil captures the packets of all peers
+ */
+func (device *Device) SetCapturePeer(pk *NoisePublicKey) {
+	device.capture.Lock()
+	defer device.capture.Unlock()
+	if pk == nil {
+		device.capture.peer = nil
+	} else {
+		filter := *pk
+		device.capture.peer = &filter
+	}
+}
+
+/* Sets the size in bytes at which the capture is stopped,
+ * zero disables the limit
+ */
+func (device *Device) SetCaptureMaxSize(size int64) error {
+	if size < 0 {
+		return errors.New("invalid capture size")
+	}
+	device.capture.Lock()
+	defer device.capture.Unlock()
+	device.capture.maxSize = size
+	return nil
+}
+
+func (device *Device) capturePacket(peer *Peer, packet []byte, direction int) {
+	device.capture.Lock()
+	defer device.capture.Unlock()
+
+	writer := device.capture.writer
+	if writer == nil {
+		return
+	}
+
+	if filter := device.capture.peer; filter != nil && !peer.handshake.remoteStatic.Equals(*filter) {
+		return
+	}
+
+	comment := "peer=" + base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
+	writer.preparePacket(packet, time.Now(), direction, comment)
+
+	if max := device.capture.maxSize; max > 0 && writer.written+writer.finishedSize() > max {
+		device.log.Info.Println("Packet capture reached maximum size of", max, "bytes")
+		device.unsafeStopCapture()
+		return
+	}
+
+	if err := writer.finishBlock(); err != nil {
+		device.log.Error.Println("Failed to write captured packet:", err)
+		device.unsafeStopCapture()
+	}
+}
@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngTestPacket struct {
+	data    []byte
+	flags   uint32
+	comment string
+}
+
+/* Parses the enhanced packet blocks of a pcapng file,
+ * checking the framing of every block
+ */
+func parsePcapng(t *testing.T, file []byte) []pcapngTestPacket {
+	var packets []pcapngTestPacket
+	for i := 0; len(file) > 0; i++ {
+		if len(file) < 12 {
+			t.Fatal("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(file[0:4])
+		length := binary.LittleEndian.Uint32(file[4:8])
+		if length%4 != 0 || int(length) > len(file) {
+			t.Fatal("invalid block length", length)
+		}
+		if binary.LittleEndian.Uint32(file[length-4:length]) != length {
+			t.Fatal("trailing block length does not match")
+		}
+		body := file[8 : length-4]
+		file = file[length:]
+
+		switch {
+		case i == 0:
+			if blockType != pcapngBlockSectionHeader || binary.LittleEndian.Uint32(body[0:4]) != pcapngByteOrderMagic {
+				t.Fatal("missing section header")
+			}
+		case i == 1:
+			if blockType != pcapngBlockInterfaceDescriptor || binary.LittleEndian.Uint16(body[0:2]) != pcapngLinkTypeRaw {
+				t.Fatal("missing raw interface description")
+			}
+		case blockType == pcapngBlockEnhancedPacket:
+			var packet pcapngTestPacket
+			captured := binary.LittleEndian.Uint32(body[12:16])
+			packet.data = body[20 : 20+captured]
+			options := body[20+pcapngPad(int(captured)):]
+			for len(options) >= 4 {
+				code := binary.LittleEndian.Uint16(options[0:2])
+				size := int(binary.LittleEndian.Uint16(options[2:4]))
+				value := options[4 : 4+size]
+				switch code {
+				case pcapngOptionPacketFlags:
+					packet.flags = binary.LittleEndian.Uint32(value)
+				case pcapngOptionComment:
+					packet.comment = string(value)
+				}
+				if code == pcapngOptionEnd {
+					break
+				}
+				options = options[4+pcapngPad(size):]
+			}
+			packets = append(packets, packet)
+		default:
+			t.Fatal("unexpected block type", blockType)
+		}
+	}
+	return packets
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var file bytes.Buffer
+	writer, err := newPcapngWriter(&file)
+	assertNil(t, err)
+
+	packets := []pcapngTestPacket{
+		{data: ping(nil, nil), flags: pcapngFlagOutbound, comment: "peer=a"},
+		{data: []byte{0x45, 1, 2}, flags: pcapngFlagInbound, comment: "peer=bb"},
+	}
+	directions := []int{captureOutbound, captureInbound}
+	for i, packet := range packets {
+		writer.preparePacket(packet.data, time.Now(), directions[i], packet.comment)
+		assertNil(t, writer.finishBlock())
+	}
+	if writer.written != int64(file.Len()) {
+		t.Fatal("written size", writer.written, "does not match file size", file.Len())
+	}
+
+	parsed := parsePcapng(t, file.Bytes())
+	if len(parsed) != len(packets) {
+		t.Fatal("expected", len(packets), "packets, got", len(parsed))
+	}
+	for i := range packets {
+		assertEqual(t, parsed[i].data, packets[i].data)
+		if parsed[i].flags != packets[i].flags || parsed[i].comment != packets[i].comment {
+			t.Fatal("packet options not preserved:", parsed[i])
+		}
+	}
+}
+
+func TestCapturePeerFilterAndMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard-capture")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	peer1, peer2 := &Peer{device: device}, &Peer{device: device}
+	peer1.handshake.remoteStatic[0] = 1
+	peer2.handshake.remoteStatic[0] = 2
+
+	assertNil(t, device.StartCapture(path))
+	device.SetCapturePeer(&peer1.handshake.remoteStatic)
+	assertNil(t, device.SetCaptureMaxSize(1024))
+
+	packet := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		device.capturePacket(peer1, packet, captureOutbound)
+		device.capturePacket(peer2, packet, captureInbound)
+	}
+	if device.capture.enabled.Get() {
+		t.Fatal("capture not stopped at maximum size")
+	}
+
+	file, err := ioutil.ReadFile(path)
+	assertNil(t, err)
+	if len(file) > 1024 {
+		t.Fatal("capture exceeds maximum size:", len(file))
+	}
+	parsed := parsePcapng(t, file)
+	if len(parsed) == 0 {
+		t.Fatal("no packets captured")
+	}
+	comment := "peer=" + base64.StdEncoding.EncodeToString(peer1.handshake.remoteStatic[:])
+	for _, packet := range parsed {
+		if packet.comment != comment {
+			t.Fatal("captured packet of filtered peer:", packet.comment)
+		}
+	}
+
+	// existing files are never overwritten
+
+	if device.StartCapture(path) == nil {
+		device.StopCapture()
+		t.Fatal("capture overwrote an existing file")
+	}
+}
@@ -7,8 +7,10 @@ package device
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -18,6 +20,8 @@ const (
 	ConnRoutineNumber = 2
 )
 
+var errNativeEndpoint = errors.New("endpoint not of native transport")
+
 /* A Bind handles listening on a port for both IPv6 and IPv4 UDP traffic
  */
 type Bind interface {
@@ -28,6 +32,196 @@ type Bind interface {
 	Close() error
 }
 
+/* A Bind able to send datagrams with a firewall mark other than the one set with SetMark
+ */
+type MarkedBind interface {
+	Bind
+	SendWithMark(buff []byte, end Endpoint, mark uint32) error
+}
+
+/* A SocketHook is called with every UDP socket created by CreateBind before it is bound,
+ * e.g. to set socket options or to exclude the socket from routing through the tunnel.
+ * Returning an error aborts the creation of the bind.
+ */
+type SocketHook func(network string, fd uintptr) error
+
+/* A Transport creates the binds and endpoints WireGuard messages are exchanged through
+ */
+type Transport interface {
+	Name() string // transport in uapi terminology
+	CreateBind(port uint16, device *Device) (Bind, uint16, error)
+	CreateEndpoint(s string) (Endpoint, error)
+}
+
+type udpTransport struct{}
+
+/* The default transport, over the native UDP bind of the platform
+ */
+var UDPTransport Transport = udpTransport{}
+
+func (udpTransport) Name() string {
+	return "udp"
+}
+
+func (udpTransport) CreateBind(port uint16, device *Device) (Bind, uint16, error) {
+	bind, port, err := CreateBind(port, device)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bind, port, nil
+}
+
+func (udpTransport) CreateEndpoint(s string) (Endpoint, error) {
+	return CreateEndpoint(s)
+}
+
+/* Returns the transport of the name, for the transports without configuration:
+ * the websocket and socks5 transports are configured and set through Device.SetTransport
+ */
+func transportByName(name string) (Transport, error) {
+	for _, transport := range []Transport{UDPTransport, TCPTransport} {
+		if transport.Name() == name {
+			return transport, nil
+		}
+	}
+	switch name {
+	case "websocket", "socks5":
+		return nil, errors.New("transport requires configuration through the API")
+	}
+	return nil, errors.New("unknown transport")
+}
+
+/* Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeTransport() Transport {
+	if device.net.transport == nil {
+		return UDPTransport
+	}
+	return device.net.transport
+}
+
+/* Creates an endpoint of the transport of the device
+ */
+func (device *Device) CreateEndpoint(s string) (Endpoint, error) {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.unsafeTransport().CreateEndpoint(s)
+}
+
+/* Changes the transport of the device, converting the endpoints of all peers
+ */
+func (device *Device) SetTransport(transport Transport) error {
+	device.net.Lock()
+	if device.unsafeTransport() == transport {
+		device.net.Unlock()
+		return nil
+	}
+
+	// only datagrams of the UDP transport carry per-peer marks
+
+	if transport != UDPTransport {
+		device.peers.RLock()
+		for _, peer := range device.peers.keyMap {
+			if atomic.LoadUint32(&peer.fwmark) != 0 {
+				device.peers.RUnlock()
+				device.net.Unlock()
+				return fmt.Errorf("per-peer fwmark of %v not supported by transport %s", peer, transport.Name())
+			}
+		}
+		device.peers.RUnlock()
+	}
+
+	// close the binds of the old transport before converting endpoints
+
+	if err := unsafeCloseBind(device); err != nil {
+		device.net.Unlock()
+		return err
+	}
+	device.net.transport = transport
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		peer.unsafeConvertEndpoints(transport)
+		peer.Unlock()
+	}
+	device.peers.RUnlock()
+	device.net.Unlock()
+
+	return device.BindUpdate()
+}
+
+/* Recreates the endpoints of the peer for the transport, dropping those it cannot represent
+ *
+ * Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeConvertEndpoints(transport Transport) {
+	convert := func(endpoint Endpoint) Endpoint {
+		if endpoint == nil {
+			return nil
+		}
+		if _, ok := endpoint.(*RelayEndpoint); ok {
+			return nil // offered again if the transport relays
+		}
+		converted, err := transport.CreateEndpoint(endpoint.DstToString())
+		if err != nil {
+			peer.device.log.Info.Println(peer, "- Dropping endpoint", endpoint.DstToString(), "not supported by transport:", err)
+			return nil
+		}
+		return converted
+	}
+
+	peer.endpointBind = nil
+
+	punchCandidates := peer.punch.candidates[:0]
+	for _, endpoint := range peer.punch.candidates {
+		if converted := convert(endpoint); converted != nil {
+			punchCandidates = append(punchCandidates, converted)
+		}
+	}
+	peer.punch.candidates = punchCandidates
+
+	if len(peer.endpoints.candidates) == 0 {
+		peer.endpoint = convert(peer.endpoint)
+		return
+	}
+
+	active := peer.endpoints.candidates[peer.endpoints.active]
+	candidates := peer.endpoints.candidates[:0]
+	peer.endpoint = nil
+	peer.endpoints.active = 0
+	for _, endpoint := range peer.endpoints.candidates {
+		converted := convert(endpoint)
+		if converted == nil {
+			continue
+		}
+		if endpoint == active {
+			peer.endpoint = converted
+			peer.endpoints.active = len(candidates)
+		}
+		candidates = append(candidates, converted)
+	}
+	peer.endpoints.candidates = candidates
+	peer.endpoints.relay = false
+	if peer.endpoint == nil && len(candidates) > 0 {
+		peer.endpoint = candidates[0]
+	}
+}
+
+/* A Bind with adjustable socket buffers,
+ * counting datagrams the kernel dropped for lack of buffer space
+ */
+type BufferedBind interface {
+	Bind
+	SetBufferSizes(receive, send int) error // zero keeps the size
+	Drops() uint64
+}
+
+func bufferSizingSupported() bool {
+	_, ok := interface{}(new(nativeBind)).(BufferedBind)
+	return ok
+}
+
 /* An Endpoint maintains the source/destination caching for a peer
  *
  * dst : the remote address of a peer ("endpoint" in uapi terminology)
@@ -75,14 +269,109 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 func unsafeCloseBind(device *Device) error {
 	var err error
 	netc := &device.net
+	for _, bind := range append([]Bind{netc.bind}, netc.extraBinds...) {
+		if buffered, ok := bind.(BufferedBind); ok {
+			netc.drops += buffered.Drops()
+		}
+	}
 	if netc.bind != nil {
 		err = netc.bind.Close()
 		netc.bind = nil
 	}
+	for _, bind := range netc.extraBinds {
+		bind.Close()
+	}
+	netc.extraBinds = nil
 	netc.stopping.Wait()
 	return err
 }
 
+/* Applies the socket settings of the device to a new bind
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeConfigureBind(bind Bind) error {
+	if device.net.fwmark != 0 {
+		if err := bind.SetMark(device.net.fwmark); err != nil {
+			return err
+		}
+	}
+	if device.net.rcvbuf != 0 || device.net.sndbuf != 0 {
+		if buffered, ok := bind.(BufferedBind); ok {
+			return buffered.SetBufferSizes(device.net.rcvbuf, device.net.sndbuf)
+		}
+	}
+	return nil
+}
+
+/* Returns the number of datagrams dropped by the kernel for lack of socket buffer space
+ */
+func (device *Device) SocketDrops() uint64 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.unsafeSocketDrops()
+}
+
+/* Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeSocketDrops() uint64 {
+	drops := device.net.drops
+	for _, bind := range append([]Bind{device.net.bind}, device.net.extraBinds...) {
+		if buffered, ok := bind.(BufferedBind); ok {
+			drops += buffered.Drops()
+		}
+	}
+	return drops
+}
+
+/* Returns the native bind of the device, beneath the obfuscation and relaying
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeNativeBind() (*nativeBind, bool) {
+	bind := device.net.bind
+	if obfuscated, ok := bind.(*obfuscatedBind); ok {
+		bind = obfuscated.Bind
+	}
+	if relayed, ok := bind.(*relayBind); ok {
+		bind = relayed.Bind
+	}
+	nb, ok := bind.(*nativeBind)
+	return nb, ok
+}
+
+/* Returns the bind if it is still open, the main bind otherwise
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeReplyBind(bind Bind) Bind {
+	for _, extra := range device.net.extraBinds {
+		if extra == bind {
+			return bind
+		}
+	}
+	return device.net.bind
+}
+
+/* Sets the additional ports to listen on, besides the listening port.
+ * Takes effect on the next BindUpdate.
+ */
+func (device *Device) SetAdditionalListenPorts(ports []uint16) {
+	device.net.Lock()
+	device.net.extraPorts = append([]uint16(nil), ports...)
+	device.net.Unlock()
+}
+
+/* Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeStartReceiving(bind Bind) {
+	device.net.starting.Add(ConnRoutineNumber)
+	device.net.stopping.Add(ConnRoutineNumber)
+	go device.RoutineReceiveIncoming(ipv4.Version, bind)
+	go device.RoutineReceiveIncoming(ipv6.Version, bind)
+	device.net.starting.Wait()
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 
 	device.net.Lock()
@@ -101,6 +390,11 @@ func (device *Device) BindSetMark(mark uint32) error {
 		if err := device.net.bind.SetMark(mark); err != nil {
 			return err
 		}
+		for _, bind := range device.net.extraBinds {
+			if err := bind.SetMark(mark); err != nil {
+				return err
+			}
+		}
 	}
 
 	// clear cached source addresses
@@ -118,11 +412,92 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+/* Sets the local address to listen on for the address family of ip, nil listens on all addresses.
+ * With an address set for only one family, the bind does not listen on the other family.
+ */
+func (device *Device) BindSetListenAddress(ip net.IP) error {
+	if !bindRestrictionSupported {
+		return errors.New("listen address not supported on this platform")
+	}
+
+	device.net.Lock()
+	if ip == nil {
+		device.net.listenAddr4 = nil
+		device.net.listenAddr6 = nil
+	} else if ip4 := ip.To4(); ip4 != nil {
+		device.net.listenAddr4 = ip4
+	} else {
+		device.net.listenAddr6 = ip.To16()
+	}
+	device.net.Unlock()
+
+	return device.BindUpdate()
+}
+
+/* Binds the sockets to the interface, an empty name removes the restriction
+ */
+func (device *Device) BindSetInterface(name string) error {
+	if !bindRestrictionSupported {
+		return errors.New("bind interface not supported on this platform")
+	}
+
+	device.net.Lock()
+	device.net.bindInterface = name
+	device.net.Unlock()
+
+	return device.BindUpdate()
+}
+
+/* Sets the sizes of the socket buffers in bytes, zero keeps the size
+ */
+func (device *Device) BindSetBufferSizes(receive, send int) error {
+	if !bufferSizingSupported() {
+		return errors.New("socket buffer sizes not supported on this platform")
+	}
+	if receive < 0 || send < 0 {
+		return errors.New("invalid socket buffer size")
+	}
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if receive != 0 {
+		device.net.rcvbuf = receive
+	}
+	if send != 0 {
+		device.net.sndbuf = send
+	}
+	if !device.isUp.Get() || device.net.bind == nil {
+		return nil
+	}
+
+	for _, bind := range append([]Bind{device.net.bind}, device.net.extraBinds...) {
+		if buffered, ok := bind.(BufferedBind); ok {
+			if err := buffered.SetBufferSizes(receive, send); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* Sets the hook called with the sockets of binds created from now on
+ */
+func (device *Device) SetSocketHook(hook SocketHook) {
+	device.net.Lock()
+	device.net.socketHook = hook
+	device.net.Unlock()
+}
+
 func (device *Device) BindUpdate() error {
 
 	device.net.Lock()
 	defer device.net.Unlock()
 
+	// offer or withdraw the relay endpoints for the new bind, once the peer locks taken below are released
+
+	defer device.unsafeUpdateRelayEndpoints()
+
 	// close existing sockets
 
 	if err := unsafeCloseBind(device); err != nil {
@@ -137,20 +512,39 @@ func (device *Device) BindUpdate() error {
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = CreateBind(netc.port, device)
+		netc.bind, netc.port, err = device.unsafeTransport().CreateBind(netc.port, device)
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
 			return err
 		}
+		netc.bind = device.unsafeObfuscateBind(device.unsafeRelayBind(netc.bind))
+
+		// set fwmark and buffer sizes
+
+		if err := device.unsafeConfigureBind(netc.bind); err != nil {
+			return err
+		}
 
-		// set fwmark
+		// bind to additional ports, keeping the others if one fails
 
-		if netc.fwmark != 0 {
-			err = netc.bind.SetMark(netc.fwmark)
+		var extraErr error
+		for i, port := range netc.extraPorts {
+			bind, newPort, err := device.unsafeTransport().CreateBind(port, device)
+			if err == nil {
+				if err = device.unsafeConfigureBind(bind); err != nil {
+					bind.Close()
+				}
+			}
 			if err != nil {
-				return err
+				device.log.Error.Println("Failed to bind additional port", port, ":", err)
+				if extraErr == nil {
+					extraErr = err
+				}
+				continue
 			}
+			netc.extraPorts[i] = newPort
+			netc.extraBinds = append(netc.extraBinds, device.unsafeObfuscateBind(bind))
 		}
 
 		// clear cached source addresses
@@ -167,13 +561,18 @@ func (device *Device) BindUpdate() error {
 
 		// start receiving routines
 
-		device.net.starting.Add(ConnRoutineNumber)
-		device.net.stopping.Add(ConnRoutineNumber)
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
-		device.net.starting.Wait()
+		device.unsafeStartReceiving(netc.bind)
+		for _, bind := range netc.extraBinds {
+			device.unsafeStartReceiving(bind)
+		}
 
 		device.log.Debug.Println("UDP bind has been updated")
+
+		// rediscover the public address of the new socket
+
+		device.DiscoverPublicEndpoint()
+
+		return extraErr
 	}
 
 	return nil
@@ -8,8 +8,11 @@
 package device
 
 import (
+	"context"
+	"errors"
 	"net"
 	"os"
+	"strconv"
 	"syscall"
 )
 
@@ -20,6 +23,8 @@ import (
  * See conn_linux.go for an implementation on the linux platform.
  */
 
+const bindRestrictionSupported = false
+
 type nativeBind struct {
 	ipv4       *net.UDPConn
 	ipv6       *net.UDPConn
@@ -66,14 +71,27 @@ func (e *NativeEndpoint) SrcToString() string {
 	return ""
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
+func listenNet(network string, port int, hook SocketHook) (*net.UDPConn, int, error) {
 
-	// listen
+	// listen, passing the socket to the hook before binding
 
-	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	var config net.ListenConfig
+	if hook != nil {
+		config.Control = func(network, address string, c syscall.RawConn) error {
+			var hookErr error
+			if err := c.Control(func(fd uintptr) {
+				hookErr = hook(network, fd)
+			}); err != nil {
+				return err
+			}
+			return hookErr
+		}
+	}
+	pconn, err := config.ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
 	if err != nil {
 		return nil, 0, err
 	}
+	conn := pconn.(*net.UDPConn)
 
 	// retrieve port
 
@@ -88,6 +106,19 @@ func listenNet(network string, port int) (*net.UDPConn, int, error) {
 	return conn, uaddr.Port, nil
 }
 
+/* Binds the socket of a stream listener or connection to the interface,
+ * never set without bind restriction support
+ */
+func bindRawConnToDevice(conn syscall.RawConn, iface string) error {
+	return nil
+}
+
+/* Checks that datagrams can be sent with the mark, never without marked send support
+ */
+func probeMarkedSend(mark uint32) error {
+	return errors.New("not supported on this platform")
+}
+
 func extractErrno(err error) error {
 	opErr, ok := err.(*net.OpError)
 	if !ok {
@@ -106,12 +137,17 @@ func CreateBind(uport uint16, device *Device) (Bind, uint16, error) {
 
 	port := int(uport)
 
-	bind.ipv4, port, err = listenNet("udp4", port)
+	var hook SocketHook
+	if device != nil {
+		hook = device.net.socketHook
+	}
+
+	bind.ipv4, port, err = listenNet("udp4", port, hook)
 	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
 		return nil, 0, err
 	}
 
-	bind.ipv6, port, err = listenNet("udp6", port)
+	bind.ipv6, port, err = listenNet("udp6", port, hook)
 	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
 		bind.ipv4.Close()
 		bind.ipv4 = nil
@@ -156,7 +192,10 @@ func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 
 func (bind *nativeBind) Send(buff []byte, endpoint Endpoint) error {
 	var err error
-	nend := endpoint.(*NativeEndpoint)
+	nend, ok := endpoint.(*NativeEndpoint)
+	if !ok {
+		return errNativeEndpoint
+	}
 	if nend.IP.To4() != nil {
 		if bind.ipv4 == nil {
 			return syscall.EAFNOSUPPORT
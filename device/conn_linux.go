@@ -21,6 +21,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -32,6 +33,8 @@ const (
 	FD_ERR = -1
 )
 
+const bindRestrictionSupported = true
+
 type IPv4Source struct {
 	src     [4]byte
 	ifindex int32
@@ -47,6 +50,12 @@ type NativeEndpoint struct {
 	dst  [unsafe.Sizeof(unix.SockaddrInet6{})]byte
 	src  [unsafe.Sizeof(IPv6Source{})]byte
 	isV6 bool
+
+	// explicitly configured source, overriding src (protected by the mutex)
+
+	pinned        bool
+	pinnedSrc     [16]byte
+	pinnedIfindex int32
 }
 
 func (endpoint *NativeEndpoint) src4() *IPv4Source {
@@ -71,10 +80,15 @@ type nativeBind struct {
 	netlinkSock   int
 	netlinkCancel *rwcancel.RWCancel
 	lastMark      uint32
+	drops4        uint32 // datagrams dropped by the kernel, as last reported on the socket
+	drops6        uint32
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
+var _ pinnableEndpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*nativeBind)(nil)
+var _ MarkedBind = (*nativeBind)(nil)
+var _ BufferedBind = (*nativeBind)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
@@ -146,11 +160,26 @@ func CreateBind(port uint16, device *Device) (*nativeBind, uint16, error) {
 
 	go bind.routineRouteListener(device)
 
+	// listen on configured addresses and interface only
+
+	var addr4, addr6 net.IP
+	var iface string
+	var hook SocketHook
+	if device != nil {
+		addr4, addr6 = device.net.listenAddr4, device.net.listenAddr6
+		iface = device.net.bindInterface
+		hook = device.net.socketHook
+	}
+	restricted := addr4 != nil || addr6 != nil
+
 	// attempt ipv6 bind, update port if successful
 
-	bind.sock6, newPort, err = create6(port)
+	bind.sock6, newPort, err = FD_ERR, port, syscall.EAFNOSUPPORT
+	if !restricted || addr6 != nil {
+		bind.sock6, newPort, err = create6(port, addr6, iface, hook)
+	}
 	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
+		if err != syscall.EAFNOSUPPORT || addr6 != nil {
 			bind.netlinkCancel.Cancel()
 			return nil, 0, err
 		}
@@ -160,9 +189,12 @@ func CreateBind(port uint16, device *Device) (*nativeBind, uint16, error) {
 
 	// attempt ipv4 bind, update port if successful
 
-	bind.sock4, newPort, err = create4(port)
+	bind.sock4, newPort, err = FD_ERR, port, syscall.EAFNOSUPPORT
+	if !restricted || addr4 != nil {
+		bind.sock4, newPort, err = create4(port, addr4, iface, hook)
+	}
 	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
+		if err != syscall.EAFNOSUPPORT || addr4 != nil {
 			bind.netlinkCancel.Cancel()
 			unix.Close(bind.sock6)
 			return nil, 0, err
@@ -209,6 +241,40 @@ func (bind *nativeBind) SetMark(value uint32) error {
 	return nil
 }
 
+/* Sets the buffer size of both sockets,
+ * exceeding the system limit if privileged (SO_RCVBUFFORCE / SO_SNDBUFFORCE)
+ */
+func (bind *nativeBind) SetBufferSizes(receive, send int) error {
+	for _, sock := range []int{bind.sock4, bind.sock6} {
+		if sock == -1 {
+			continue
+		}
+		if receive != 0 {
+			if err := setBufferSize(sock, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, receive); err != nil {
+				return err
+			}
+		}
+		if send != 0 {
+			if err := setBufferSize(sock, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, send); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setBufferSize(sock int, force int, opt int, size int) error {
+	err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, force, size)
+	if err == unix.EPERM {
+		err = unix.SetsockoptInt(sock, unix.SOL_SOCKET, opt, size)
+	}
+	return err
+}
+
+func (bind *nativeBind) Drops() uint64 {
+	return uint64(atomic.LoadUint32(&bind.drops4)) + uint64(atomic.LoadUint32(&bind.drops6))
+}
+
 func closeUnblock(fd int) error {
 	// shutdown to unblock readers and writers
 	unix.Shutdown(fd, unix.SHUT_RDWR)
@@ -243,6 +309,7 @@ func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 		bind.sock6,
 		buff,
 		&end,
+		&bind.drops6,
 	)
 	return n, &end, err
 }
@@ -256,22 +323,36 @@ func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
 		bind.sock4,
 		buff,
 		&end,
+		&bind.drops4,
 	)
 	return n, &end, err
 }
 
 func (bind *nativeBind) Send(buff []byte, end Endpoint) error {
-	nend := end.(*NativeEndpoint)
+	return bind.SendWithMark(buff, end, 0)
+}
+
+/* Sends with the mark as SO_MARK control message (requires CAP_NET_ADMIN),
+ * zero sends with the mark of the socket
+ */
+func (bind *nativeBind) SendWithMark(buff []byte, end Endpoint, mark uint32) error {
+	nend, ok := end.(*NativeEndpoint)
+	if !ok {
+		return errNativeEndpoint
+	}
+	if mark == bind.lastMark {
+		mark = 0
+	}
 	if !nend.isV6 {
 		if bind.sock4 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send4(bind.sock4, nend, buff)
+		return send4(bind.sock4, nend, buff, mark)
 	} else {
 		if bind.sock6 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send6(bind.sock6, nend, buff)
+		return send6(bind.sock6, nend, buff, mark)
 	}
 }
 
@@ -336,6 +417,21 @@ func (end *NativeEndpoint) ClearSrc() {
 	}
 }
 
+func (end *NativeEndpoint) pinSrc(src4 net.IP, src6 net.IP, ifindex int32) {
+	end.Lock()
+	defer end.Unlock()
+
+	end.pinnedSrc = [16]byte{}
+	end.pinnedIfindex = ifindex
+	if !end.isV6 {
+		copy(end.pinnedSrc[:], src4.To4())
+		end.pinned = src4 != nil || ifindex != 0
+	} else {
+		copy(end.pinnedSrc[:], src6.To16())
+		end.pinned = src6 != nil || ifindex != 0
+	}
+}
+
 func zoneToUint32(zone string) (uint32, error) {
 	if zone == "" {
 		return 0, nil
@@ -347,7 +443,28 @@ func zoneToUint32(zone string) (uint32, error) {
 	return uint32(n), err
 }
 
-func create4(port uint16) (int, uint16, error) {
+/* Binds the socket to the interface, if any
+ */
+func bindToDevice(fd int, iface string) error {
+	if iface == "" {
+		return nil
+	}
+	return unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+}
+
+/* Binds the socket of a stream listener or connection to the interface, if any
+ */
+func bindRawConnToDevice(conn syscall.RawConn, iface string) error {
+	var err error
+	if controlErr := conn.Control(func(fd uintptr) {
+		err = bindToDevice(int(fd), iface)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+func create4(port uint16, ip net.IP, iface string, hook SocketHook) (int, uint16, error) {
 
 	// create socket
 
@@ -364,6 +481,7 @@ func create4(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet4{
 		Port: int(port),
 	}
+	copy(addr.Addr[:], ip.To4())
 
 	// set sockopts and bind
 
@@ -386,6 +504,25 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := unix.SetsockoptInt(
+			fd,
+			unix.SOL_SOCKET,
+			unix.SO_RXQ_OVFL,
+			1,
+		); err != nil {
+			return err
+		}
+
+		if hook != nil {
+			if err := hook("udp4", uintptr(fd)); err != nil {
+				return err
+			}
+		}
+
+		if err := bindToDevice(fd, iface); err != nil {
+			return err
+		}
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -400,7 +537,7 @@ func create4(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func create6(port uint16) (int, uint16, error) {
+func create6(port uint16, ip net.IP, iface string, hook SocketHook) (int, uint16, error) {
 
 	// create socket
 
@@ -419,6 +556,12 @@ func create6(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet6{
 		Port: int(port),
 	}
+	copy(addr.Addr[:], ip.To16())
+	if iface != "" && ip.IsLinkLocalUnicast() {
+		if intr, err := net.InterfaceByName(iface); err == nil {
+			addr.ZoneId = uint32(intr.Index)
+		}
+	}
 
 	if err := func() error {
 
@@ -440,6 +583,15 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := unix.SetsockoptInt(
+			fd,
+			unix.SOL_SOCKET,
+			unix.SO_RXQ_OVFL,
+			1,
+		); err != nil {
+			return err
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -449,6 +601,16 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if hook != nil {
+			if err := hook("udp6", uintptr(fd)); err != nil {
+				return err
+			}
+		}
+
+		if err := bindToDevice(fd, iface); err != nil {
+			return err
+		}
+
 		return unix.Bind(fd, &addr)
 
 	}(); err != nil {
@@ -464,7 +626,7 @@ func create6(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func send4(sock int, end *NativeEndpoint, buff []byte) error {
+func send4(sock int, end *NativeEndpoint, buff []byte, mark uint32) error {
 
 	// construct message header
 
@@ -483,12 +645,19 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		},
 	}
 
+	var control [unsafe.Sizeof(cmsg) + markControlSpace]byte
+
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	pinned := end.pinned
+	if pinned {
+		copy(cmsg.pktinfo.Spec_dst[:], end.pinnedSrc[:4])
+		cmsg.pktinfo.Ifindex = end.pinnedIfindex
+	}
+	_, err := unix.SendmsgN(sock, buff, sendControl(control[:], (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], mark), end.dst4(), 0)
 	end.Unlock()
 
-	if err == nil {
-		return nil
+	if err == nil || pinned {
+		return err
 	}
 
 	// clear src and retry
@@ -497,14 +666,14 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, sendControl(control[:], (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], mark), end.dst4(), 0)
 		end.Unlock()
 	}
 
 	return err
 }
 
-func send6(sock int, end *NativeEndpoint, buff []byte) error {
+func send6(sock int, end *NativeEndpoint, buff []byte, mark uint32) error {
 
 	// construct message header
 
@@ -527,12 +696,19 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		cmsg.pktinfo.Ifindex = 0
 	}
 
+	var control [unsafe.Sizeof(cmsg) + markControlSpace]byte
+
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	pinned := end.pinned
+	if pinned {
+		cmsg.pktinfo.Addr = end.pinnedSrc
+		cmsg.pktinfo.Ifindex = uint32(end.pinnedIfindex)
+	}
+	_, err := unix.SendmsgN(sock, buff, sendControl(control[:], (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], mark), end.dst6(), 0)
 	end.Unlock()
 
-	if err == nil {
-		return nil
+	if err == nil || pinned {
+		return err
 	}
 
 	// clear src and retry
@@ -541,23 +717,89 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, sendControl(control[:], (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], mark), end.dst6(), 0)
 		end.Unlock()
 	}
 
 	return err
 }
 
-func receive4(sock int, buff []byte, end *NativeEndpoint) (int, error) {
+/* Checks that datagrams can be sent with the mark as SO_MARK control message,
+ * which requires Linux 5.9 and CAP_NET_ADMIN, by sending an empty one to the discard port of the loopback
+ */
+func probeMarkedSend(mark uint32) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
 
-	// construct message header
+	var control [markControlSpace]byte
+	dst := unix.SockaddrInet4{Port: 9, Addr: [4]byte{127, 0, 0, 1}}
+	_, err = unix.SendmsgN(fd, nil, sendControl(control[:], nil, mark), &dst, 0)
+	return err
+}
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
+/* Upper bound of the space of a SO_MARK control message
+ */
+const markControlSpace = 32
+
+/* Assembles the control data of a datagram in buf,
+ * appending a SO_MARK control message to pktinfo for a non-zero mark
+ */
+func sendControl(buf []byte, pktinfo []byte, mark uint32) []byte {
+	n := copy(buf, pktinfo)
+	if mark == 0 {
+		return buf[:n]
+	}
+	space := unix.CmsgSpace(4)
+	for i := range buf[n : n+space] {
+		buf[n+i] = 0
+	}
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&buf[n]))
+	hdr.Level = unix.SOL_SOCKET
+	hdr.Type = unix.SO_MARK
+	hdr.SetLen(unix.CmsgLen(4))
+	*(*uint32)(unsafe.Pointer(&buf[n+unix.CmsgLen(0)])) = mark
+	return buf[:n+space]
+}
+
+/* Space for the control messages of received datagrams (packet info and overflow counter)
+ */
+const receiveControlSpace = 128
+
+/* Walks the control messages of a received datagram,
+ * storing the overflow counter of the socket and returning the data of the message of the level and type
+ */
+func parseReceiveControl(control []byte, level int32, typ int32, drops *uint32) (data []byte) {
+	for len(control) >= unix.SizeofCmsghdr {
+		hdr := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		if hdr.Len < unix.SizeofCmsghdr || uint64(hdr.Len) > uint64(len(control)) {
+			break
+		}
+		payload := control[unix.CmsgLen(0):hdr.Len]
+		switch {
+		case hdr.Level == level && hdr.Type == typ:
+			data = payload
+		case hdr.Level == unix.SOL_SOCKET && hdr.Type == unix.SO_RXQ_OVFL && len(payload) >= 4:
+			atomic.StoreUint32(drops, *(*uint32)(unsafe.Pointer(&payload[0])))
+		}
+		space := unix.CmsgSpace(len(payload))
+		if space > len(control) {
+			break
+		}
+		control = control[space:]
 	}
+	return
+}
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+func receive4(sock int, buff []byte, end *NativeEndpoint, drops *uint32) (int, error) {
+
+	// construct message header
+
+	var control [receiveControlSpace]byte
+
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, control[:], 0)
 
 	if err != nil {
 		return 0, err
@@ -570,26 +812,22 @@ func receive4(sock int, buff []byte, end *NativeEndpoint) (int, error) {
 
 	// update source cache
 
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IP &&
-		cmsg.cmsghdr.Type == unix.IP_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
-		end.src4().src = cmsg.pktinfo.Spec_dst
-		end.src4().ifindex = cmsg.pktinfo.Ifindex
+	if data := parseReceiveControl(control[:oobn], unix.IPPROTO_IP, unix.IP_PKTINFO, drops); len(data) >= unix.SizeofInet4Pktinfo {
+		pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+		end.src4().src = pktinfo.Spec_dst
+		end.src4().ifindex = pktinfo.Ifindex
 	}
 
 	return size, nil
 }
 
-func receive6(sock int, buff []byte, end *NativeEndpoint) (int, error) {
+func receive6(sock int, buff []byte, end *NativeEndpoint, drops *uint32) (int, error) {
 
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}
+	var control [receiveControlSpace]byte
 
-	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
+	size, oobn, _, newDst, err := unix.Recvmsg(sock, buff, control[:], 0)
 
 	if err != nil {
 		return 0, err
@@ -602,11 +840,10 @@ func receive6(sock int, buff []byte, end *NativeEndpoint) (int, error) {
 
 	// update source cache
 
-	if cmsg.cmsghdr.Level == unix.IPPROTO_IPV6 &&
-		cmsg.cmsghdr.Type == unix.IPV6_PKTINFO &&
-		cmsg.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
-		end.src6().src = cmsg.pktinfo.Addr
-		end.dst6().ZoneId = cmsg.pktinfo.Ifindex
+	if data := parseReceiveControl(control[:oobn], unix.IPPROTO_IPV6, unix.IPV6_PKTINFO, drops); len(data) >= unix.SizeofInet6Pktinfo {
+		pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+		end.src6().src = pktinfo.Addr
+		end.dst6().ZoneId = pktinfo.Ifindex
 	}
 
 	return size, nil
@@ -679,11 +916,12 @@ func (bind *nativeBind) routineRouteListener(device *Device) {
 									pePtr.peer.Unlock()
 									break
 								}
-								if uint32(pePtr.peer.endpoint.(*NativeEndpoint).src4().ifindex) == ifidx {
+								nend, ok := pePtr.peer.endpoint.(*NativeEndpoint)
+								if !ok || uint32(nend.src4().ifindex) == ifidx {
 									pePtr.peer.Unlock()
 									break
 								}
-								pePtr.peer.endpoint.(*NativeEndpoint).ClearSrc()
+								nend.ClearSrc()
 								pePtr.peer.Unlock()
 							}
 							attr = attr[attrhdr.Len:]
@@ -699,11 +937,12 @@ func (bind *nativeBind) routineRouteListener(device *Device) {
 					i := uint32(1)
 					for _, peer := range device.peers.keyMap {
 						peer.RLock()
-						if peer.endpoint == nil || peer.endpoint.(*NativeEndpoint) == nil {
+						nend, ok := peer.endpoint.(*NativeEndpoint)
+						if !ok || nend == nil {
 							peer.RUnlock()
 							continue
 						}
-						if peer.endpoint.(*NativeEndpoint).isV6 || peer.endpoint.(*NativeEndpoint).src4().ifindex == 0 {
+						if nend.isV6 || nend.src4().ifindex == 0 {
 							peer.RUnlock()
 							break
 						}
@@ -731,17 +970,17 @@ func (bind *nativeBind) routineRouteListener(device *Device) {
 								Len:  8,
 								Type: unix.RTA_DST,
 							},
-							peer.endpoint.(*NativeEndpoint).dst4().Addr,
+							nend.dst4().Addr,
 							unix.RtAttr{
 								Len:  8,
 								Type: unix.RTA_SRC,
 							},
-							peer.endpoint.(*NativeEndpoint).src4().src,
+							nend.src4().src,
 							unix.RtAttr{
 								Len:  8,
 								Type: unix.RTA_MARK,
 							},
-							uint32(bind.lastMark),
+							peer.routingMark(bind.lastMark),
 						}
 						nlmsg.hdr.Len = uint32(unsafe.Sizeof(nlmsg))
 						reqPeerLock.Lock()
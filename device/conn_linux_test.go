@@ -0,0 +1,173 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSendControl(t *testing.T) {
+	cmsg := struct {
+		cmsghdr unix.Cmsghdr
+		pktinfo unix.Inet4Pktinfo
+	}{
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IP,
+			Type:  unix.IP_PKTINFO,
+			Len:   unix.SizeofInet4Pktinfo + unix.SizeofCmsghdr,
+		},
+		unix.Inet4Pktinfo{Ifindex: 1},
+	}
+	pktinfo := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	var buf [unsafe.Sizeof(cmsg) + markControlSpace]byte
+
+	if control := sendControl(buf[:], pktinfo, 0); !bytes.Equal(control, pktinfo) {
+		t.Fatal("control data altered without mark")
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(sendControl(buf[:], pktinfo, 0xbeef))
+	assertNil(t, err)
+	if len(msgs) != 2 || msgs[0].Header.Type != unix.IP_PKTINFO || msgs[1].Header.Level != unix.SOL_SOCKET || msgs[1].Header.Type != unix.SO_MARK {
+		t.Fatal("unexpected control messages")
+	}
+	if len(msgs[1].Data) != 4 || *(*uint32)(unsafe.Pointer(&msgs[1].Data[0])) != 0xbeef {
+		t.Fatal("unexpected mark", msgs[1].Data)
+	}
+}
+
+func TestSendWithMark(t *testing.T) {
+	sock4, port, err := create4(0, nil, "", nil)
+	if err != nil {
+		t.Skip("unable to create socket:", err)
+	}
+	defer unix.Close(sock4)
+	bind := &nativeBind{sock4: sock4, sock6: -1}
+
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	assertNil(t, err)
+
+	msg := []byte("marked")
+	err = bind.SendWithMark(msg, end, 42)
+	if err == unix.EPERM {
+		t.Skip("insufficient privileges to mark datagrams")
+	}
+	assertNil(t, err)
+
+	buff := make([]byte, 64)
+	n, _, err := bind.ReceiveIPv4(buff)
+	assertNil(t, err)
+	assertEqual(t, buff[:n], msg)
+}
+
+func TestBindListenAddress(t *testing.T) {
+	loopback := loopbackInterface(t)
+
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	device.net.listenAddr4 = net.IPv4(127, 0, 0, 1).To4()
+	device.net.bindInterface = loopback.Name
+
+	bind, port, err := CreateBind(0, device)
+	if err == unix.EPERM {
+		t.Skip("insufficient privileges to bind to interface")
+	}
+	assertNil(t, err)
+	defer bind.Close()
+
+	if bind.sock6 != FD_ERR {
+		t.Fatal("listening on IPv6 without address")
+	}
+	sa, err := unix.Getsockname(bind.sock4)
+	assertNil(t, err)
+	addr := sa.(*unix.SockaddrInet4)
+	if addr.Addr != [4]byte{127, 0, 0, 1} || addr.Port != int(port) {
+		t.Fatal("not listening on address", addr)
+	}
+	name, err := unix.GetsockoptString(bind.sock4, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	assertNil(t, err)
+	assertEquals(t, name, loopback.Name)
+}
+
+func TestSocketHook(t *testing.T) {
+	sockets := make(map[string]int)
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	device.SetSocketHook(func(network string, fd uintptr) error {
+		sockets[network] = int(fd)
+		return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY, 6)
+	})
+
+	bind, _, err := CreateBind(0, device)
+	assertNil(t, err)
+	defer bind.Close()
+
+	for network, sock := range map[string]int{"udp4": bind.sock4, "udp6": bind.sock6} {
+		if sock == FD_ERR {
+			continue
+		}
+		if sockets[network] != sock {
+			t.Fatal("hook not called with", network, "socket")
+		}
+		priority, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_PRIORITY)
+		assertNil(t, err)
+		if priority != 6 {
+			t.Fatal("socket option of hook not applied")
+		}
+	}
+
+	// failing hooks abort the bind
+
+	device.SetSocketHook(func(network string, fd uintptr) error {
+		return unix.EPERM
+	})
+	if bind, _, err := CreateBind(0, device); err == nil {
+		bind.Close()
+		t.Fatal("created bind despite failing hook")
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	sock4, port, err := create4(0, net.IPv4(127, 0, 0, 1), "", nil)
+	if err != nil {
+		t.Skip("unable to create socket:", err)
+	}
+	defer unix.Close(sock4)
+	bind := &nativeBind{sock4: sock4, sock6: -1}
+
+	assertNil(t, bind.SetBufferSizes(4096, 1<<20))
+	size, err := unix.GetsockoptInt(sock4, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	assertNil(t, err)
+	if size < 1<<20 {
+		t.Fatal("send buffer not resized:", size)
+	}
+
+	// overflow the receive buffer
+
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	assertNil(t, err)
+	msg := make([]byte, 1024)
+	for i := 0; i < 64; i++ {
+		assertNil(t, bind.Send(msg, end))
+	}
+
+	// the counter arrives with the next datagram queued after the drops
+
+	buff := make([]byte, 2048)
+	for i := 0; i < 64 && bind.Drops() == 0; i++ {
+		_, _, err := bind.ReceiveIPv4(buff)
+		assertNil(t, err)
+		assertNil(t, bind.Send(msg, end))
+	}
+	if bind.Drops() == 0 {
+		t.Fatal("socket overflow not counted")
+	}
+}
@@ -0,0 +1,390 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* WireGuard datagrams through a SOCKS5 proxy (RFC 1928), using UDP ASSOCIATE.
+ *
+ * Every datagram carries the SOCKS UDP request header, addressing the endpoint.
+ * The association lasts as long as the control connection, which is re-established when dropped.
+ */
+
+const (
+	socks5Version         = 5
+	socks5AuthNone        = 0
+	socks5AuthPassword    = 2
+	socks5CmdUDPAssociate = 3
+	socks5AtypIPv4        = 1
+	socks5AtypDomain      = 3
+	socks5AtypIPv6        = 4
+	socks5ReplySucceeded  = 0
+)
+
+var errSOCKS5Closed = errors.New("SOCKS5 bind closed")
+
+type SOCKS5Transport struct {
+	Server   string // address of the proxy (host:port)
+	Username string // username and password for authentication, if required by the proxy
+	Password string
+}
+
+var _ Transport = (*SOCKS5Transport)(nil)
+
+func (transport *SOCKS5Transport) Name() string {
+	return "socks5"
+}
+
+func (transport *SOCKS5Transport) CreateEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return (*SOCKS5Endpoint)(addr), nil
+}
+
+/* Associates with the proxy, sending from a local socket on the port
+ */
+func (transport *SOCKS5Transport) CreateBind(port uint16, device *Device) (Bind, uint16, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bind := &socks5Bind{
+		transport: transport,
+		conn:      conn,
+		closed:    make(chan struct{}),
+	}
+	if device != nil {
+		bind.log = device.log
+	}
+	if err := bind.associate(); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	go bind.routineMaintainAssociation()
+
+	return bind, uint16(conn.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+type SOCKS5Endpoint net.UDPAddr
+
+var _ Endpoint = (*SOCKS5Endpoint)(nil)
+
+func (_ *SOCKS5Endpoint) ClearSrc() {}
+
+func (end *SOCKS5Endpoint) DstIP() net.IP {
+	return end.IP
+}
+
+func (end *SOCKS5Endpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (end *SOCKS5Endpoint) DstToBytes() []byte {
+	out := end.IP.To4()
+	if out == nil {
+		out = end.IP
+	}
+	out = append(out, byte(end.Port&0xff))
+	out = append(out, byte((end.Port>>8)&0xff))
+	return out
+}
+
+func (end *SOCKS5Endpoint) DstToString() string {
+	return (*net.UDPAddr)(end).String()
+}
+
+func (end *SOCKS5Endpoint) SrcToString() string {
+	return ""
+}
+
+type socks5Bind struct {
+	transport *SOCKS5Transport
+	log       *Logger
+	conn      *net.UDPConn
+	closed    chan struct{}
+
+	sync.RWMutex
+	isClosed bool
+	control  net.Conn     // control connection of the association
+	relay    *net.UDPAddr // relay address of the association
+}
+
+var _ Bind = (*socks5Bind)(nil)
+
+/* Performs the SOCKS5 handshake on the control connection, returning the relay address
+ */
+func (transport *SOCKS5Transport) handshake(control net.Conn) (*net.UDPAddr, error) {
+	var buff [2 + 255 + 255 + 1]byte
+
+	// negotiate authentication method
+
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if transport.Username != "" {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := control.Write(methods); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(control, buff[:2]); err != nil {
+		return nil, err
+	}
+	if buff[0] != socks5Version {
+		return nil, errors.New("not a SOCKS5 proxy")
+	}
+
+	switch buff[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if transport.Username == "" || len(transport.Username) > 255 || len(transport.Password) > 255 {
+			return nil, errors.New("SOCKS5 proxy requires valid credentials")
+		}
+		request := append([]byte{1, byte(len(transport.Username))}, transport.Username...)
+		request = append(request, byte(len(transport.Password)))
+		request = append(request, transport.Password...)
+		if _, err := control.Write(request); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(control, buff[:2]); err != nil {
+			return nil, err
+		}
+		if buff[1] != 0 {
+			return nil, errors.New("SOCKS5 authentication failed")
+		}
+	default:
+		return nil, errors.New("no acceptable SOCKS5 authentication method")
+	}
+
+	// request association, the address of the client is not known in advance
+
+	if _, err := control.Write([]byte{socks5Version, socks5CmdUDPAssociate, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(control, buff[:4]); err != nil {
+		return nil, err
+	}
+	if buff[1] != socks5ReplySucceeded {
+		return nil, errors.New("SOCKS5 UDP associate failed with reply " + strconv.Itoa(int(buff[1])))
+	}
+
+	var relay net.UDPAddr
+	switch buff[3] {
+	case socks5AtypIPv4:
+		if _, err := io.ReadFull(control, buff[:net.IPv4len+2]); err != nil {
+			return nil, err
+		}
+		relay.IP = net.IP(append([]byte(nil), buff[:net.IPv4len]...))
+		relay.Port = int(binary.BigEndian.Uint16(buff[net.IPv4len:]))
+	case socks5AtypIPv6:
+		if _, err := io.ReadFull(control, buff[:net.IPv6len+2]); err != nil {
+			return nil, err
+		}
+		relay.IP = net.IP(append([]byte(nil), buff[:net.IPv6len]...))
+		relay.Port = int(binary.BigEndian.Uint16(buff[net.IPv6len:]))
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(control, buff[:1]); err != nil {
+			return nil, err
+		}
+		size := int(buff[0])
+		if _, err := io.ReadFull(control, buff[:size+2]); err != nil {
+			return nil, err
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(string(buff[:size]), strconv.Itoa(int(binary.BigEndian.Uint16(buff[size:])))))
+		if err != nil {
+			return nil, err
+		}
+		relay = *addr
+	default:
+		return nil, errors.New("invalid SOCKS5 address type")
+	}
+
+	// an unspecified relay address refers to the proxy
+
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	if ip4 := relay.IP.To4(); ip4 != nil {
+		relay.IP = ip4
+	}
+	return &relay, nil
+}
+
+/* Establishes a new association with the proxy
+ */
+func (bind *socks5Bind) associate() error {
+	control, err := net.DialTimeout("tcp", bind.transport.Server, StreamDialTimeout)
+	if err != nil {
+		return err
+	}
+	control.SetDeadline(time.Now().Add(StreamDialTimeout))
+	relay, err := bind.transport.handshake(control)
+	if err != nil {
+		control.Close()
+		return err
+	}
+	control.SetDeadline(time.Time{})
+
+	bind.Lock()
+	defer bind.Unlock()
+
+	if bind.isClosed {
+		control.Close()
+		return errSOCKS5Closed
+	}
+	bind.control = control
+	bind.relay = relay
+	return nil
+}
+
+/* Re-associates when the control connection is dropped
+ */
+func (bind *socks5Bind) routineMaintainAssociation() {
+	for {
+		bind.RLock()
+		control := bind.control
+		bind.RUnlock()
+
+		// the proxy does not send on the control connection, reading detects its closure
+
+		var buff [1]byte
+		for {
+			if _, err := control.Read(buff[:]); err != nil {
+				break
+			}
+		}
+
+		for delay := time.Second; ; delay *= 2 {
+			select {
+			case <-bind.closed:
+				return
+			default:
+			}
+			err := bind.associate()
+			if err == nil {
+				if bind.log != nil {
+					bind.log.Info.Println("Re-associated with SOCKS5 proxy", bind.transport.Server)
+				}
+				break
+			}
+			if bind.log != nil {
+				bind.log.Error.Println("Failed to re-associate with SOCKS5 proxy:", err)
+			}
+			if delay > RekeyTimeout {
+				delay = RekeyTimeout
+			}
+			select {
+			case <-bind.closed:
+				return
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+func (bind *socks5Bind) receive(buff []byte) (int, Endpoint, error) {
+	for {
+		size, from, err := bind.conn.ReadFromUDP(buff)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		bind.RLock()
+		relay := bind.relay
+		bind.RUnlock()
+		if !from.IP.Equal(relay.IP) || from.Port != relay.Port {
+			continue
+		}
+
+		// strip the header, fragments are not supported
+
+		if size < 4 || buff[2] != 0 {
+			continue
+		}
+		var end SOCKS5Endpoint
+		offset := 4
+		switch buff[3] {
+		case socks5AtypIPv4:
+			offset += net.IPv4len
+			if size < offset+2 {
+				continue
+			}
+			end.IP = net.IP(append([]byte(nil), buff[4:offset]...))
+		case socks5AtypIPv6:
+			offset += net.IPv6len
+			if size < offset+2 {
+				continue
+			}
+			end.IP = net.IP(append([]byte(nil), buff[4:offset]...))
+		default:
+			continue
+		}
+		end.Port = int(binary.BigEndian.Uint16(buff[offset:]))
+		offset += 2
+
+		return copy(buff, buff[offset:size]), &end, nil
+	}
+}
+
+func (bind *socks5Bind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.receive(buff)
+}
+
+func (bind *socks5Bind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.receive(buff)
+}
+
+func (bind *socks5Bind) Send(buff []byte, end Endpoint) error {
+	send, ok := end.(*SOCKS5Endpoint)
+	if !ok {
+		return errors.New("endpoint not of SOCKS5 transport")
+	}
+
+	var header [4 + net.IPv6len + 2]byte
+	size := 4
+	if ip4 := send.IP.To4(); ip4 != nil {
+		header[3] = socks5AtypIPv4
+		size += copy(header[size:], ip4)
+	} else {
+		header[3] = socks5AtypIPv6
+		size += copy(header[size:], send.IP.To16())
+	}
+	binary.BigEndian.PutUint16(header[size:], uint16(send.Port))
+	size += 2
+
+	bind.RLock()
+	relay := bind.relay
+	bind.RUnlock()
+
+	_, _, err := bind.conn.WriteMsgUDP(append(header[:size:size], buff...), nil, relay)
+	return err
+}
+
+func (bind *socks5Bind) SetMark(mark uint32) error {
+	return nil // not supported
+}
+
+func (bind *socks5Bind) Close() error {
+	bind.Lock()
+	defer bind.Unlock()
+
+	if bind.isClosed {
+		return nil
+	}
+	bind.isClosed = true
+	close(bind.closed)
+	bind.control.Close()
+	return bind.conn.Close()
+}
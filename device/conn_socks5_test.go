@@ -0,0 +1,249 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Minimal SOCKS5 proxy supporting UDP ASSOCIATE, with password authentication
+ */
+type testSOCKS5Server struct {
+	listener net.Listener
+	username string
+	password string
+
+	sync.Mutex
+	controls []net.Conn
+}
+
+func newTestSOCKS5Server(t *testing.T, username, password string) *testSOCKS5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	server := &testSOCKS5Server{
+		listener: listener,
+		username: username,
+		password: password,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+/* Drops the control connections, ending the associations
+ */
+func (server *testSOCKS5Server) dropAssociations() {
+	server.Lock()
+	defer server.Unlock()
+	for _, conn := range server.controls {
+		conn.Close()
+	}
+	server.controls = nil
+}
+
+func (server *testSOCKS5Server) Close() {
+	server.listener.Close()
+	server.dropAssociations()
+}
+
+func (server *testSOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var buff [512]byte
+	if _, err := io.ReadFull(conn, buff[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buff[:buff[1]]); err != nil {
+		return
+	}
+	if server.username == "" {
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		conn.Write([]byte{socks5Version, socks5AuthPassword})
+		if _, err := io.ReadFull(conn, buff[:2]); err != nil {
+			return
+		}
+		username := make([]byte, buff[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, buff[:1])
+		password := make([]byte, buff[0])
+		io.ReadFull(conn, password)
+		if string(username) != server.username || string(password) != server.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	if _, err := io.ReadFull(conn, buff[:10]); err != nil || buff[1] != socks5CmdUDPAssociate {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	reply := []byte{socks5Version, socks5ReplySucceeded, 0, socks5AtypIPv4, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+	conn.Write(reply)
+
+	server.Lock()
+	server.controls = append(server.controls, conn)
+	server.Unlock()
+
+	go server.relay(relay)
+	io.Copy(ioutil.Discard, conn)
+}
+
+/* The first sender is the client, whose datagrams carry the destination
+ */
+func (server *testSOCKS5Server) relay(relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buff := make([]byte, MaxMessageSize+4+net.IPv6len+2)
+	for {
+		size, from, err := relay.ReadFromUDP(buff[4+net.IPv4len+2:])
+		if err != nil {
+			return
+		}
+		packet := buff[4+net.IPv4len+2:][:size]
+		if client == nil {
+			client = from
+		}
+		if from.IP.Equal(client.IP) && from.Port == client.Port {
+			if size < 4+net.IPv4len+2 || packet[3] != socks5AtypIPv4 {
+				continue
+			}
+			dst := &net.UDPAddr{
+				IP:   net.IP(packet[4 : 4+net.IPv4len]),
+				Port: int(binary.BigEndian.Uint16(packet[4+net.IPv4len:])),
+			}
+			relay.WriteToUDP(packet[4+net.IPv4len+2:], dst)
+		} else {
+			header := buff[:4+net.IPv4len+2]
+			copy(header, []byte{0, 0, 0, socks5AtypIPv4})
+			copy(header[4:], from.IP.To4())
+			binary.BigEndian.PutUint16(header[4+net.IPv4len:], uint16(from.Port))
+			relay.WriteToUDP(buff[:len(header)+size], client)
+		}
+	}
+}
+
+func TestSOCKS5Transport(t *testing.T) {
+	server := newTestSOCKS5Server(t, "user", "secret")
+	defer server.Close()
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53533
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong credentials are refused
+
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelSilent, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	if dev1.SetTransport(&SOCKS5Transport{Server: server.listener.Addr().String(), Username: "user"}) == nil {
+		t.Fatal("associated with wrong credentials")
+	}
+
+	// the first device reaches the second through the proxy
+
+	assertNil(t, dev1.SetTransport(&SOCKS5Transport{
+		Server:   server.listener.Addr().String(),
+		Username: "user",
+		Password: "secret",
+	}))
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:53533`
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	pingBoth := func() {
+		for _, p := range []struct {
+			src, dst net.IP
+			in       chan []byte
+			out      chan []byte
+		}{
+			{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+			{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+		} {
+			msg := ping(p.dst, p.src)
+			p.in <- msg
+			select {
+			case msgRecv := <-p.out:
+				assertEqual(t, msgRecv, msg)
+			case <-time.After(5 * time.Second):
+				t.Fatal("ping to", p.dst, "did not transit")
+			}
+		}
+	}
+	pingBoth()
+
+	dev1.net.RLock()
+	bind := dev1.net.bind.(*socks5Bind)
+	dev1.net.RUnlock()
+	bind.RLock()
+	relay := bind.relay
+	bind.RUnlock()
+
+	// the second device sees the relay of the proxy
+
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	peer.RLock()
+	endpoint := peer.endpoint.DstToString()
+	peer.RUnlock()
+	assertEquals(t, endpoint, relay.String())
+
+	// dropping the control connection ends the association, the bind re-associates
+
+	server.dropAssociations()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bind.RLock()
+		reassociated := bind.relay != relay
+		bind.RUnlock()
+		if reassociated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bind did not re-associate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pingBoth()
+}
@@ -0,0 +1,353 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/* Binds exchanging WireGuard messages over stream connections, for networks blocking UDP.
+ *
+ * An endpoint identifies a connection by its remote address.
+ * Connections are accepted from peers and dialed in the background to endpoints without connection,
+ * a single dial per endpoint, backing off after failures.
+ * The message starting a dial is sent once connected, further messages to the endpoint
+ * are dropped until then, like lost datagrams.
+ * At most StreamMaxConnections connections are kept, those idle for StreamIdleTimeout are closed,
+ * and accepted connections must carry a message within StreamDialTimeout.
+ */
+
+var (
+	errStreamClosed     = errors.New("stream bind closed")
+	errStreamConnecting = errors.New("connecting to endpoint")
+	errStreamEndpoint   = errors.New("endpoint not of stream transport")
+	errStreamLimit      = errors.New("too many stream connections")
+)
+
+/* A connection carrying whole WireGuard messages
+ */
+type messageConn interface {
+	ReadMessage(buff []byte) (int, error)
+	WriteMessage(msg []byte) error // not called concurrently
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type StreamEndpoint net.TCPAddr
+
+var _ Endpoint = (*StreamEndpoint)(nil)
+
+func streamEndpoint(addr net.Addr) (*StreamEndpoint, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		var err error
+		tcpAddr, err = net.ResolveTCPAddr("tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	end := StreamEndpoint(*tcpAddr)
+	if ip4 := end.IP.To4(); ip4 != nil {
+		end.IP = ip4
+	}
+	return &end, nil
+}
+
+func (_ *StreamEndpoint) ClearSrc() {}
+
+func (end *StreamEndpoint) DstIP() net.IP {
+	return end.IP
+}
+
+func (end *StreamEndpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (end *StreamEndpoint) DstToBytes() []byte {
+	out := end.IP.To4()
+	if out == nil {
+		out = end.IP
+	}
+	out = append(out, byte(end.Port&0xff))
+	out = append(out, byte((end.Port>>8)&0xff))
+	return out
+}
+
+func (end *StreamEndpoint) DstToString() string {
+	return (*net.TCPAddr)(end).String()
+}
+
+func (end *StreamEndpoint) SrcToString() string {
+	return ""
+}
+
+type streamKey struct {
+	ip   [16]byte
+	port int
+}
+
+func (end *StreamEndpoint) key() (key streamKey) {
+	copy(key.ip[:], end.IP.To16())
+	key.port = end.Port
+	return
+}
+
+type streamConn struct {
+	messageConn
+	sync.Mutex // serializes writes
+}
+
+type streamDatagram struct {
+	packet   []byte
+	endpoint *StreamEndpoint
+	done     chan struct{} // signaled once the packet is copied
+}
+
+/* Dialing state of an endpoint without connection
+ */
+type streamDial struct {
+	active  bool          // a dial is in progress
+	next    time.Time     // earliest time of the next dial
+	backoff time.Duration // after the last failed dial
+}
+
+type streamBind struct {
+	dial     func(end *StreamEndpoint) (messageConn, error)
+	listener io.Closer // stops accepting connections, may be nil
+	in4      chan streamDatagram
+	in6      chan streamDatagram
+	closed   chan struct{}
+
+	sync.Mutex
+	isClosed bool
+	conns    map[streamKey]*streamConn
+	dialing  map[streamKey]*streamDial
+}
+
+var _ Bind = (*streamBind)(nil)
+
+func newStreamBind(dial func(end *StreamEndpoint) (messageConn, error)) *streamBind {
+	return &streamBind{
+		dial:    dial,
+		in4:     make(chan streamDatagram),
+		in6:     make(chan streamDatagram),
+		closed:  make(chan struct{}),
+		conns:   make(map[streamKey]*streamConn),
+		dialing: make(map[streamKey]*streamDial),
+	}
+}
+
+/* Reports whether the bind accepts no further connections
+ */
+func (bind *streamBind) full() bool {
+	bind.Lock()
+	defer bind.Unlock()
+	return bind.isClosed || len(bind.conns) >= StreamMaxConnections
+}
+
+/* Adds a connection, replacing the one to the same endpoint
+ */
+func (bind *streamBind) addConn(conn messageConn, accepted bool) (*streamConn, error) {
+	end, err := streamEndpoint(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	bind.Lock()
+	defer bind.Unlock()
+
+	if bind.isClosed {
+		conn.Close()
+		return nil, errStreamClosed
+	}
+	old, ok := bind.conns[end.key()]
+	if !ok && len(bind.conns) >= StreamMaxConnections {
+		conn.Close()
+		return nil, errStreamLimit
+	}
+	if ok {
+		old.Close()
+	}
+	sconn := &streamConn{messageConn: conn}
+	bind.conns[end.key()] = sconn
+	go bind.routineReadConn(sconn, end, accepted)
+	return sconn, nil
+}
+
+func (bind *streamBind) routineReadConn(conn *streamConn, end *StreamEndpoint, accepted bool) {
+	defer func() {
+		conn.Close()
+		bind.Lock()
+		if bind.conns[end.key()] == conn {
+			delete(bind.conns, end.key())
+		}
+		bind.Unlock()
+	}()
+
+	in := bind.in6
+	if end.IP.To4() != nil {
+		in = bind.in4
+	}
+
+	// peers dial to send, accepted connections without message are dropped early
+
+	timeout := StreamIdleTimeout
+	if accepted {
+		timeout = StreamDialTimeout
+	}
+
+	buff := make([]byte, MaxMessageSize)
+	done := make(chan struct{}, 1)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		size, err := conn.ReadMessage(buff)
+		if err != nil {
+			return
+		}
+		timeout = StreamIdleTimeout
+		select {
+		case in <- streamDatagram{packet: buff[:size], endpoint: end, done: done}:
+		case <-bind.closed:
+			return
+		}
+		select {
+		case <-done:
+		case <-bind.closed:
+			return
+		}
+	}
+}
+
+/* Returns the connection to the endpoint, dialing it in the background if there is none,
+ * sending the message once connected
+ */
+func (bind *streamBind) connection(end *StreamEndpoint, msg []byte) (*streamConn, error) {
+	key := end.key()
+
+	bind.Lock()
+	defer bind.Unlock()
+
+	if conn, ok := bind.conns[key]; ok {
+		return conn, nil
+	}
+	if bind.isClosed {
+		return nil, errStreamClosed
+	}
+	if bind.dial == nil {
+		return nil, errStreamConnecting
+	}
+	dial, ok := bind.dialing[key]
+	if !ok {
+		dial = &streamDial{}
+		bind.dialing[key] = dial
+	}
+	if dial.active || time.Now().Before(dial.next) {
+		return nil, errStreamConnecting
+	}
+	dial.active = true
+	go bind.routineDial(end, dial, append([]byte(nil), msg...))
+	return nil, nil
+}
+
+func (bind *streamBind) routineDial(end *StreamEndpoint, dial *streamDial, msg []byte) {
+	var conn *streamConn
+	dialed, err := bind.dial(end)
+	if err == nil {
+		conn, err = bind.addConn(dialed, false)
+	}
+
+	bind.Lock()
+	dial.active = false
+	if err != nil {
+		dial.backoff *= 2
+		if dial.backoff < StreamDialMinBackoff {
+			dial.backoff = StreamDialMinBackoff
+		} else if dial.backoff > StreamDialMaxBackoff {
+			dial.backoff = StreamDialMaxBackoff
+		}
+		dial.next = time.Now().Add(dial.backoff)
+	} else if bind.dialing[end.key()] == dial {
+		delete(bind.dialing, end.key())
+	}
+	bind.Unlock()
+
+	if err == nil {
+		bind.write(conn, msg)
+	}
+}
+
+func (bind *streamBind) receive(in chan streamDatagram, buff []byte) (int, Endpoint, error) {
+	select {
+	case datagram := <-in:
+		size := copy(buff, datagram.packet)
+		datagram.done <- struct{}{}
+		return size, datagram.endpoint, nil
+	case <-bind.closed:
+		return 0, nil, errStreamClosed
+	}
+}
+
+func (bind *streamBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.receive(bind.in4, buff)
+}
+
+func (bind *streamBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.receive(bind.in6, buff)
+}
+
+func (bind *streamBind) Send(buff []byte, end Endpoint) error {
+	send, ok := end.(*StreamEndpoint)
+	if !ok {
+		return errStreamEndpoint
+	}
+	conn, err := bind.connection(send, buff)
+	if conn == nil {
+		return err
+	}
+	return bind.write(conn, buff)
+}
+
+func (bind *streamBind) write(conn *streamConn, msg []byte) error {
+	conn.Lock()
+	err := conn.WriteMessage(msg)
+	conn.Unlock()
+
+	if err != nil {
+		conn.Close() // removed by the reading routine
+	}
+	return err
+}
+
+func (bind *streamBind) SetMark(mark uint32) error {
+	return nil // not supported
+}
+
+func (bind *streamBind) Close() error {
+	bind.Lock()
+	defer bind.Unlock()
+
+	if bind.isClosed {
+		return nil
+	}
+	bind.isClosed = true
+	close(bind.closed)
+
+	var err error
+	if bind.listener != nil {
+		err = bind.listener.Close()
+	}
+	for _, conn := range bind.conns {
+		conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMessageConn struct {
+	remote    net.Addr
+	deadlines chan time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestMessageConn(port int) *testMessageConn {
+	return &testMessageConn{
+		remote:    &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port},
+		deadlines: make(chan time.Time, 1),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (conn *testMessageConn) ReadMessage(buff []byte) (int, error) {
+	<-conn.closed
+	return 0, io.EOF
+}
+
+func (conn *testMessageConn) WriteMessage(msg []byte) error {
+	return nil
+}
+
+func (conn *testMessageConn) SetReadDeadline(t time.Time) error {
+	select {
+	case conn.deadlines <- t:
+	default:
+	}
+	return nil
+}
+
+func (conn *testMessageConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *testMessageConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return nil
+}
+
+func TestStreamBindDial(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer listener.Close()
+
+	dials := make(chan struct{}, 8)
+	proceed := make(chan error)
+	bind := newStreamBind(func(end *StreamEndpoint) (messageConn, error) {
+		dials <- struct{}{}
+		if err := <-proceed; err != nil {
+			return nil, err
+		}
+		conn, err := net.Dial("tcp", end.DstToString())
+		if err != nil {
+			return nil, err
+		}
+		return newFramedConn(conn), nil
+	})
+	defer bind.Close()
+
+	end, err := TCPTransport.CreateEndpoint(listener.Addr().String())
+	assertNil(t, err)
+
+	// sends do not wait for the dial, a single one per endpoint
+
+	if err := bind.Send([]byte("first"), end); err != nil {
+		t.Fatal("message starting the dial not kept:", err)
+	}
+	<-dials
+	if err := bind.Send([]byte("dropped"), end); err != errStreamConnecting {
+		t.Fatal("message sent while dialing:", err)
+	}
+	select {
+	case <-dials:
+		t.Fatal("endpoint dialed twice")
+	default:
+	}
+
+	// a failed dial backs off
+
+	dialing := func() bool {
+		bind.Lock()
+		defer bind.Unlock()
+		return bind.dialing[end.(*StreamEndpoint).key()].active
+	}
+	proceed <- errors.New("unreachable")
+	for i := 0; dialing(); i++ {
+		if i == 100 {
+			t.Fatal("dial did not fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := bind.Send([]byte("dropped"), end); err != errStreamConnecting {
+		t.Fatal("dialed again without backing off:", err)
+	}
+
+	// the message starting a dial is sent once connected
+
+	bind.Lock()
+	bind.dialing[end.(*StreamEndpoint).key()].next = time.Time{}
+	bind.Unlock()
+	assertNil(t, bind.Send([]byte("held"), end))
+	<-dials
+	proceed <- nil
+
+	conn, err := listener.Accept()
+	assertNil(t, err)
+	defer conn.Close()
+	buff := make([]byte, MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	size, err := newFramedConn(conn).ReadMessage(buff)
+	assertNil(t, err)
+	assertEquals(t, string(buff[:size]), "held")
+}
+
+func TestStreamBindLimits(t *testing.T) {
+	bind := newStreamBind(nil)
+	defer bind.Close()
+
+	// accepted connections must carry a message soon
+
+	conn := newTestMessageConn(1)
+	_, err := bind.addConn(conn, true)
+	assertNil(t, err)
+	if deadline := <-conn.deadlines; time.Until(deadline) > StreamDialTimeout {
+		t.Fatal("no early read deadline of accepted connection", deadline)
+	}
+	dialed := newTestMessageConn(2)
+	_, err = bind.addConn(dialed, false)
+	assertNil(t, err)
+	if deadline := <-dialed.deadlines; time.Until(deadline) <= StreamDialTimeout || time.Until(deadline) > StreamIdleTimeout {
+		t.Fatal("no idle read deadline of dialed connection", deadline)
+	}
+
+	// connections beyond the limit are refused, replacements accepted
+
+	for port := 3; port <= StreamMaxConnections; port++ {
+		_, err := bind.addConn(newTestMessageConn(port), true)
+		assertNil(t, err)
+	}
+	if !bind.full() {
+		t.Fatal("bind not full")
+	}
+	excess := newTestMessageConn(StreamMaxConnections + 1)
+	if _, err := bind.addConn(excess, true); err != errStreamLimit {
+		t.Fatal("connection beyond the limit accepted:", err)
+	}
+	select {
+	case <-excess.closed:
+	default:
+		t.Fatal("refused connection not closed")
+	}
+	_, err = bind.addConn(newTestMessageConn(1), true)
+	assertNil(t, err)
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("replaced connection not closed")
+	}
+}
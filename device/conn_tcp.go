@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/* WireGuard messages over TCP connections,
+ * each message prefixed by its length as 16-bit big-endian integer.
+ *
+ * Both sides listen on the listening port (TCP) and dial the endpoints of peers,
+ * restricted to the listen addresses and bind interface of the device like the UDP sockets.
+ */
+
+type tcpTransport struct{}
+
+var TCPTransport Transport = tcpTransport{}
+
+func (tcpTransport) Name() string {
+	return "tcp"
+}
+
+func (tcpTransport) CreateEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamEndpoint{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, nil
+}
+
+func (tcpTransport) CreateBind(port uint16, device *Device) (Bind, uint16, error) {
+
+	// listen on configured addresses and interface only, and dial from them
+
+	var addr4, addr6 net.IP
+	var iface string
+	if device != nil {
+		addr4, addr6 = device.net.listenAddr4, device.net.listenAddr6
+		iface = device.net.bindInterface
+	}
+	control := func(network, address string, conn syscall.RawConn) error {
+		return bindRawConnToDevice(conn, iface)
+	}
+
+	listeners, port, err := listenTCP(port, addr4, addr6, control)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bind := newStreamBind(func(end *StreamEndpoint) (messageConn, error) {
+		dialer := net.Dialer{Timeout: StreamDialTimeout, Control: control}
+		if addr4 != nil || addr6 != nil {
+			local := addr6
+			if end.IP.To4() != nil {
+				local = addr4
+			}
+			if local == nil {
+				return nil, errors.New("no listen address of the address family of the endpoint")
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		conn, err := dialer.Dial("tcp", end.DstToString())
+		if err != nil {
+			return nil, err
+		}
+		return newFramedConn(conn), nil
+	})
+	bind.listener = listeners
+
+	for _, listener := range listeners {
+		go routineAcceptTCP(bind, listener)
+	}
+
+	return bind, port, nil
+}
+
+type tcpListeners []net.Listener
+
+func (listeners tcpListeners) Close() error {
+	var err error
+	for _, listener := range listeners {
+		if closeErr := listener.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+/* Listens on the port of the addresses, or of all addresses if none
+ */
+func listenTCP(port uint16, addr4, addr6 net.IP, control func(string, string, syscall.RawConn) error) (tcpListeners, uint16, error) {
+	config := net.ListenConfig{Control: control}
+	if addr4 == nil && addr6 == nil {
+		listener, err := config.Listen(context.Background(), "tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+		if err != nil {
+			return nil, 0, err
+		}
+		return tcpListeners{listener}, uint16(listener.Addr().(*net.TCPAddr).Port), nil
+	}
+
+	// the second listener uses the port of the first
+
+	var listeners tcpListeners
+	for _, addr := range []struct {
+		network string
+		ip      net.IP
+	}{{"tcp4", addr4}, {"tcp6", addr6}} {
+		if addr.ip == nil {
+			continue
+		}
+		listener, err := config.Listen(context.Background(), addr.network, net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(port))))
+		if err != nil {
+			listeners.Close()
+			return nil, 0, err
+		}
+		listeners = append(listeners, listener)
+		port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	}
+	return listeners, port, nil
+}
+
+func routineAcceptTCP(bind *streamBind, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+			return
+		}
+		bind.addConn(newFramedConn(conn), true)
+	}
+}
+
+/* A TCP connection carrying length-prefixed messages
+ */
+type framedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	header [2]byte
+	frame  [2 + MaxMessageSize]byte
+}
+
+func newFramedConn(conn net.Conn) *framedConn {
+	return &framedConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (conn *framedConn) ReadMessage(buff []byte) (int, error) {
+	if _, err := io.ReadFull(conn.reader, conn.header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(conn.header[:]))
+	if size > len(buff) {
+		return 0, errors.New("message exceeds buffer")
+	}
+	return io.ReadFull(conn.reader, buff[:size])
+}
+
+func (conn *framedConn) WriteMessage(msg []byte) error {
+	if len(msg) > MaxMessageSize {
+		return errors.New("message too large")
+	}
+	binary.BigEndian.PutUint16(conn.frame[:2], uint16(len(msg)))
+	size := 2 + copy(conn.frame[2:], msg)
+	conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	_, err := conn.Write(conn.frame[:size])
+	return err
+}
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFramedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn1, conn2 := newFramedConn(c1), newFramedConn(c2)
+	defer conn1.Close()
+	defer conn2.Close()
+
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xff}, MaxMessageSize)}
+	go func() {
+		for _, msg := range messages {
+			conn1.WriteMessage(msg)
+		}
+	}()
+
+	buff := make([]byte, MaxMessageSize)
+	for _, msg := range messages {
+		size, err := conn2.ReadMessage(buff)
+		assertNil(t, err)
+		assertEqual(t, buff[:size], msg)
+	}
+
+	if conn1.WriteMessage(make([]byte, MaxMessageSize+1)) == nil {
+		t.Fatal("wrote message exceeding the length prefix")
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53531
+transport=tcp
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:53532`
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second device learns the endpoint from the accepted connection
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53532
+transport=tcp
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(time.Second):
+			t.Fatal("ping to", p.dst, "did not transit")
+		}
+	}
+
+	// switching back converts the endpoints
+
+	assertNil(t, dev1.SetTransport(UDPTransport))
+	peer := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer.RLock()
+	_, ok := peer.endpoint.(*StreamEndpoint)
+	endpoint := peer.endpoint.DstToString()
+	peer.RUnlock()
+	if ok || endpoint != "127.0.0.1:53532" {
+		t.Fatal("endpoint not converted to transport")
+	}
+}
+
+func TestTCPListenAddress(t *testing.T) {
+	listeners, port, err := listenTCP(0, net.IPv4(127, 0, 0, 1), nil, nil)
+	assertNil(t, err)
+	defer listeners.Close()
+	if len(listeners) != 1 || listeners[0].Addr().String() != net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))) {
+		t.Fatal("not listening on the listen address only", listeners)
+	}
+}
+
+func TestTCPFirewallMark(t *testing.T) {
+	tun := NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	defer dev.Close()
+
+	cfg := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725`
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+		t.Fatal(err)
+	}
+	assertNil(t, dev.SetTransport(TCPTransport))
+
+	// stream connections carry no per-peer marks
+
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg + "\nfwmark=42"))); err == nil {
+		t.Fatal("fwmark accepted by tcp transport")
+	}
+
+	// nor can the transport change to one while marks are set
+
+	assertNil(t, dev.SetTransport(UDPTransport))
+	if probeMarkedSend(42) != nil {
+		t.Skip("unable to send marked datagrams")
+	}
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg + "\nfwmark=42"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetTransport(TCPTransport); err == nil {
+		t.Fatal("transport without marks set for marked peer")
+	}
+}
@@ -0,0 +1,517 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* WireGuard messages in WebSocket binary frames (RFC 6455), for networks only permitting HTTP(S).
+ *
+ * The server side is an http.Handler, to be mounted in an HTTP server,
+ * clients dial the endpoints of peers (through an HTTP CONNECT proxy, if configured, over TLS for https proxies).
+ * Endpoints identify the underlying TCP connections, the dialed address for clients.
+ * A transport is used by a single device.
+ */
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type WebSocketTransport struct {
+	Path      string                                // request path (default "/")
+	TLSConfig *tls.Config                           // TLS configuration of clients, nil dials without TLS
+	Proxy     func(*http.Request) (*url.URL, error) // proxy of clients (e.g. http.ProxyFromEnvironment), may be nil
+
+	mutex sync.Mutex
+	bind  *streamBind // bind of the device, receiving accepted connections
+}
+
+var _ Transport = (*WebSocketTransport)(nil)
+var _ http.Handler = (*WebSocketTransport)(nil)
+
+func (transport *WebSocketTransport) Name() string {
+	return "websocket"
+}
+
+func (transport *WebSocketTransport) CreateEndpoint(s string) (Endpoint, error) {
+	return TCPTransport.CreateEndpoint(s)
+}
+
+/* Creates a bind dialing endpoints, incoming connections are accepted by ServeHTTP
+ */
+func (transport *WebSocketTransport) CreateBind(port uint16, device *Device) (Bind, uint16, error) {
+	bind := newStreamBind(transport.dial)
+
+	transport.mutex.Lock()
+	transport.bind = bind
+	transport.mutex.Unlock()
+
+	return bind, port, nil
+}
+
+func (transport *WebSocketTransport) url(end *StreamEndpoint) *url.URL {
+	u := &url.URL{
+		Scheme: "ws",
+		Host:   end.DstToString(),
+		Path:   transport.Path,
+	}
+	if transport.TLSConfig != nil {
+		u.Scheme = "wss"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u
+}
+
+func (transport *WebSocketTransport) dial(end *StreamEndpoint) (messageConn, error) {
+	deadline := time.Now().Add(StreamDialTimeout)
+	target := transport.url(end)
+
+	request, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect, through the proxy if any
+
+	var proxy *url.URL
+	if transport.Proxy != nil {
+		// the proxy is chosen by the scheme of the tunneled protocol
+		proxyRequest := *request
+		proxyRequest.URL = &url.URL{Scheme: "https", Host: target.Host}
+		if transport.TLSConfig == nil {
+			proxyRequest.URL.Scheme = "http"
+		}
+		proxy, err = transport.Proxy(&proxyRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = transport.dialProxy(&dialer, proxy)
+		if err == nil {
+			err = proxyConnect(conn, proxy, target.Host, deadline)
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", target.Host)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	// upgrade to TLS and WebSocket
+
+	conn.SetDeadline(deadline)
+	if transport.TLSConfig != nil {
+		tlsConn := tls.Client(conn, transport.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key[:])
+
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", encodedKey)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+
+	reader := bufio.NewReader(conn)
+	err = request.Write(conn)
+	if err == nil {
+		var response *http.Response
+		response, err = http.ReadResponse(reader, request)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode != http.StatusSwitchingProtocols ||
+				response.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(encodedKey) {
+				err = errors.New("websocket upgrade refused: " + response.Status)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newWebSocketConn(conn, reader, (*net.TCPAddr)(end), true), nil
+}
+
+/* Connects to the HTTP proxy, over TLS for https proxies
+ */
+func (transport *WebSocketTransport) dialProxy(dialer *net.Dialer, proxy *url.URL) (net.Conn, error) {
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, errors.New("unsupported proxy scheme: " + proxy.Scheme)
+	}
+	conn, err := dialer.Dial("tcp", canonicalProxyAddr(proxy))
+	if err != nil || proxy.Scheme == "http" {
+		return conn, err
+	}
+
+	// trust the roots configured for the peers, if any
+
+	config := &tls.Config{}
+	if transport.TLSConfig != nil {
+		config = transport.TLSConfig.Clone()
+	}
+	config.ServerName = proxy.Hostname()
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(dialer.Deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func canonicalProxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	if proxy.Scheme == "https" {
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+/* Opens a tunnel to the address through an HTTP proxy
+ */
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string, deadline time.Time) error {
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return err
+	}
+
+	// the reader must not consume data following the response
+
+	response, err := http.ReadResponse(bufio.NewReaderSize(&oneByteReader{conn}, 1), request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("proxy refused connection: " + response.Status)
+	}
+	return nil
+}
+
+type oneByteReader struct {
+	io.Reader
+}
+
+func (reader *oneByteReader) Read(buff []byte) (int, error) {
+	if len(buff) > 1 {
+		buff = buff[:1]
+	}
+	return reader.Reader.Read(buff)
+}
+
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Accepts WebSocket connections of peers, passing them to the bind of the device
+ */
+func (transport *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	transport.mutex.Lock()
+	bind := transport.bind
+	transport.mutex.Unlock()
+	if bind == nil {
+		http.Error(w, "Device not up", http.StatusServiceUnavailable)
+		return
+	}
+	if bind.full() {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buffered.WriteString("Upgrade: websocket\r\n")
+	buffered.WriteString("Connection: Upgrade\r\n")
+	buffered.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	bind.addConn(newWebSocketConn(conn, buffered.Reader, conn.RemoteAddr(), false), true)
+}
+
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+
+	webSocketMaxHeaderSize  = 14
+	webSocketMaxControlSize = 125
+)
+
+/* A WebSocket connection carrying messages in binary frames
+ */
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	client bool // masks frames
+
+	header  [webSocketMaxHeaderSize]byte
+	control [webSocketMaxControlSize]byte
+
+	writeLock sync.Mutex // replies to control frames are written by the reader
+	frame     [webSocketMaxHeaderSize + MaxMessageSize]byte
+	masks     [256]byte // random masking keys
+	maskIndex int
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, remote net.Addr, client bool) *webSocketConn {
+	wsConn := &webSocketConn{
+		Conn:   conn,
+		reader: reader,
+		remote: remote,
+		client: client,
+	}
+	wsConn.maskIndex = len(wsConn.masks)
+	return wsConn
+}
+
+func (conn *webSocketConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func maskBytes(mask []byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i&3]
+	}
+}
+
+/* Reads the next frame header, returning the opcode, FIN bit and payload length,
+ * failing on frames not masked by clients or masked by servers
+ */
+func (conn *webSocketConn) readHeader(client bool) (opcode byte, fin bool, size uint64, mask []byte, err error) {
+	header := conn.header[:]
+	if _, err = io.ReadFull(conn.reader, header[:2]); err != nil {
+		return
+	}
+	opcode = header[0] & 0xf
+	fin = header[0]&0x80 != 0
+	masked := header[1]&0x80 != 0
+	size = uint64(header[1] & 0x7f)
+	if masked == client {
+		err = errors.New("invalid websocket frame masking")
+		return
+	}
+
+	switch size {
+	case 126:
+		if _, err = io.ReadFull(conn.reader, header[2:4]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		if _, err = io.ReadFull(conn.reader, header[2:10]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(header[2:10])
+	}
+
+	if masked {
+		mask = header[10:14]
+		_, err = io.ReadFull(conn.reader, mask)
+	}
+	return
+}
+
+func (conn *webSocketConn) ReadMessage(buff []byte) (int, error) {
+	size := 0
+	fragmented := false
+
+	for {
+		opcode, fin, length, mask, err := conn.readHeader(conn.client)
+		if err != nil {
+			return 0, err
+		}
+
+		// control frames may be interleaved with fragments
+
+		if opcode >= webSocketOpClose {
+			if length > webSocketMaxControlSize || !fin {
+				return 0, errors.New("invalid websocket control frame")
+			}
+			payload := conn.control[:length]
+			if _, err := io.ReadFull(conn.reader, payload); err != nil {
+				return 0, err
+			}
+			if mask != nil {
+				maskBytes(mask, payload)
+			}
+			switch opcode {
+			case webSocketOpClose:
+				conn.writeFrame(webSocketOpClose, payload)
+				return 0, io.EOF
+			case webSocketOpPing:
+				if err := conn.writeFrame(webSocketOpPong, payload); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+
+		switch {
+		case opcode == webSocketOpBinary && !fragmented:
+		case opcode == webSocketOpContinuation && fragmented:
+		default:
+			return 0, errors.New("unexpected websocket frame")
+		}
+		if length > uint64(len(buff)-size) {
+			return 0, errors.New("message exceeds buffer")
+		}
+
+		payload := buff[size : size+int(length)]
+		if _, err := io.ReadFull(conn.reader, payload); err != nil {
+			return 0, err
+		}
+		if mask != nil {
+			maskBytes(mask, payload)
+		}
+		size += int(length)
+
+		if fin {
+			return size, nil
+		}
+		fragmented = true
+	}
+}
+
+func (conn *webSocketConn) WriteMessage(msg []byte) error {
+	if len(msg) > MaxMessageSize {
+		return errors.New("message too large")
+	}
+	return conn.writeFrame(webSocketOpBinary, msg)
+}
+
+func (conn *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	frame := conn.frame[:]
+	frame[0] = 0x80 | opcode
+	offset := 2
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+		offset = 4
+	default:
+		frame[1] = 127
+		binary.BigEndian.PutUint64(frame[2:10], uint64(len(payload)))
+		offset = 10
+	}
+
+	var mask []byte
+	if conn.client {
+		if conn.maskIndex == len(conn.masks) {
+			if _, err := rand.Read(conn.masks[:]); err != nil {
+				return err
+			}
+			conn.maskIndex = 0
+		}
+		frame[1] |= 0x80
+		mask = frame[offset : offset+4]
+		copy(mask, conn.masks[conn.maskIndex:conn.maskIndex+4])
+		conn.maskIndex += 4
+		offset += 4
+	}
+
+	size := offset + copy(frame[offset:], payload)
+	if mask != nil {
+		maskBytes(mask, frame[offset:size])
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	_, err := conn.Write(frame[:size])
+	return err
+}
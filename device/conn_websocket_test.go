@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := newWebSocketConn(c1, bufio.NewReader(c1), nil, true)
+	server := newWebSocketConn(c2, bufio.NewReader(c2), nil, false)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.WriteMessage([]byte("masked message"))
+		client.WriteMessage(make([]byte, MaxMessageSize))
+
+		// fragmented message with interleaved ping, masked by zero keys
+
+		c1.Write([]byte{webSocketOpBinary, 0x80 | 3, 0, 0, 0, 0, 'a', 'b', 'c'})
+		c1.Write([]byte{0x80 | webSocketOpPing, 0x80 | 1, 0, 0, 0, 0, 'p'})
+		c1.Write([]byte{0x80 | webSocketOpContinuation, 0x80 | 2, 0, 0, 0, 0, 'd', 'e'})
+	}()
+
+	buff := make([]byte, MaxMessageSize)
+	size, err := server.ReadMessage(buff)
+	assertNil(t, err)
+	assertEquals(t, string(buff[:size]), "masked message")
+
+	size, err = server.ReadMessage(buff)
+	assertNil(t, err)
+	if size != MaxMessageSize {
+		t.Fatal("unexpected size of large message", size)
+	}
+
+	pong := make(chan []byte)
+	go func() {
+		frame := make([]byte, 3)
+		io.ReadFull(c1, frame)
+		pong <- frame
+	}()
+	size, err = server.ReadMessage(buff)
+	assertNil(t, err)
+	assertEquals(t, string(buff[:size]), "abcde")
+	assertEqual(t, <-pong, []byte{0x80 | webSocketOpPong, 1, 'p'})
+
+	// servers fail on unmasked frames, clients on masked ones
+
+	go c1.Write([]byte{0x80 | webSocketOpBinary, 1, 'u'})
+	if _, err := server.ReadMessage(buff); err == nil {
+		t.Fatal("server accepted unmasked frame")
+	}
+	go c2.Write([]byte{0x80 | webSocketOpBinary, 0x80 | 1, 0, 0, 0, 0, 'm'})
+	if _, err := client.ReadMessage(buff); err == nil {
+		t.Fatal("client accepted masked frame")
+	}
+}
+
+/* Relays CONNECT requests, counting the tunnels
+ */
+type testConnectProxy struct {
+	tunnels chan string
+}
+
+func (proxy *testConnectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	proxy.tunnels <- r.Host
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	go func() {
+		io.Copy(conn, target)
+		conn.Close()
+	}()
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	// the second device accepts connections through an HTTPS server
+
+	serverTransport := &WebSocketTransport{}
+	mux := http.NewServeMux()
+	mux.Handle("/wireguard", serverTransport)
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	assertNil(t, dev2.SetTransport(serverTransport))
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first device connects through a proxy
+
+	proxy := &testConnectProxy{tunnels: make(chan string, 16)}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	assertNil(t, err)
+
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ServerName = "example.com"
+	clientTransport := &WebSocketTransport{
+		Path:      "/wireguard",
+		TLSConfig: tlsConfig,
+		Proxy:     http.ProxyURL(proxyURL),
+	}
+
+	serverAddr := server.Listener.Addr().String()
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=` + serverAddr
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	assertNil(t, dev1.SetTransport(clientTransport))
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping to", p.dst, "did not transit")
+		}
+	}
+
+	select {
+	case host := <-proxy.tunnels:
+		assertEquals(t, host, serverAddr)
+	default:
+		t.Fatal("connection did not use the proxy")
+	}
+
+	// plain requests are refused
+
+	response, err := server.Client().Get(server.URL + "/wireguard")
+	assertNil(t, err)
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatal("unexpected status of plain request", response.Status)
+	}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	serverTransport := &WebSocketTransport{}
+	_, _, err := serverTransport.CreateBind(0, nil)
+	assertNil(t, err)
+	server := httptest.NewTLSServer(serverTransport)
+	defer server.Close()
+
+	// the proxy is reached over TLS, trusting the roots configured for peers
+
+	proxy := &testConnectProxy{tunnels: make(chan string, 16)}
+	proxyServer := httptest.NewTLSServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	assertNil(t, err)
+
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ServerName = "example.com"
+	clientTransport := &WebSocketTransport{
+		TLSConfig: tlsConfig,
+		Proxy:     http.ProxyURL(proxyURL),
+	}
+	end, err := clientTransport.CreateEndpoint(server.Listener.Addr().String())
+	assertNil(t, err)
+	conn, err := clientTransport.dial(end.(*StreamEndpoint))
+	assertNil(t, err)
+	conn.Close()
+	assertEquals(t, <-proxy.tunnels, server.Listener.Addr().String())
+
+	// proxies of other protocols are refused
+
+	socksURL, err := url.Parse("socks5://" + proxyServer.Listener.Addr().String())
+	assertNil(t, err)
+	clientTransport.Proxy = http.ProxyURL(socksURL)
+	if _, err := clientTransport.dial(end.(*StreamEndpoint)); err == nil {
+		t.Fatal("connected through socks5 proxy as HTTP proxy")
+	}
+}
@@ -0,0 +1,411 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Stateful connection tracking for restricted peers,
+ * which may only answer flows started from the TUN side.
+ *
+ * Flows (TCP, UDP, ICMP echo and other protocols by address pair)
+ * are tracked when their packets leave through the tunnel;
+ * inbound packets of a restricted peer are only accepted if they belong to a tracked flow
+ * or are ICMP errors about one. Non-initial fragments carry no ports and are accepted.
+ */
+
+const (
+	protocolICMPv4 = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+type conntrackKey struct {
+	version    uint8
+	protocol   uint8
+	localPort  uint16 // ICMP echo identifier for ICMP
+	remotePort uint16
+	local      [net.IPv6len]byte
+	remote     [net.IPv6len]byte
+}
+
+type conntrackFlow struct {
+	expires time.Time
+	replied bool // seen traffic in both directions
+	closing bool // seen TCP FIN or RST
+}
+
+/* A packet as seen by connection tracking,
+ * src and dst are in the direction of the packet
+ */
+type conntrackTuple struct {
+	version  uint8
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	src      [net.IPv6len]byte
+	dst      [net.IPv6len]byte
+	icmpType uint8
+	tcpFlags uint8
+	fragment bool   // non-initial fragment, without transport header
+	embedded []byte // packet quoted by an ICMP error
+}
+
+func icmpIsEchoRequest(version uint8, icmpType uint8) bool {
+	if version == ipv4.Version {
+		return icmpType == 8
+	}
+	return icmpType == 128
+}
+
+func icmpIsEchoReply(version uint8, icmpType uint8) bool {
+	if version == ipv4.Version {
+		return icmpType == 0
+	}
+	return icmpType == 129
+}
+
+func icmpIsError(version uint8, icmpType uint8) bool {
+	if version == ipv4.Version {
+		return icmpType == 3 || icmpType == 4 || icmpType == 11 || icmpType == 12
+	}
+	return icmpType >= 1 && icmpType <= 4
+}
+
+/* Parses the IP and transport headers of a packet,
+ * tolerating the truncated packets quoted by ICMP errors
+ */
+func (tuple *conntrackTuple) parse(packet []byte) bool {
+	var payload []byte
+
+	if len(packet) < 1 {
+		return false
+	}
+
+	switch tuple.version = packet[0] >> 4; tuple.version {
+	case ipv4.Version:
+		headerLen := int(packet[0]&0x0f) * 4
+		if headerLen < ipv4.HeaderLen || len(packet) < headerLen {
+			return false
+		}
+		tuple.protocol = packet[9]
+		copy(tuple.src[:], packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len])
+		copy(tuple.dst[:], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			tuple.fragment = true
+			return true
+		}
+		payload = packet[headerLen:]
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return false
+		}
+		copy(tuple.src[:], packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len])
+		copy(tuple.dst[:], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+
+		// skip extension headers
+
+		next := packet[6]
+		offset := ipv6.HeaderLen
+		for i := 0; ; i++ {
+			if i == 8 {
+				return false
+			}
+			if next == 0 || next == 43 || next == 60 { // hop-by-hop, routing, destination options
+				if len(packet) < offset+2 {
+					return false
+				}
+				next, offset = packet[offset], offset+(int(packet[offset+1])+1)*8
+				continue
+			}
+			if next == 44 { // fragment
+				if len(packet) < offset+8 {
+					return false
+				}
+				if binary.BigEndian.Uint16(packet[offset+2:offset+4])>>3 != 0 {
+					tuple.protocol = packet[offset]
+					tuple.fragment = true
+					return true
+				}
+				next, offset = packet[offset], offset+8
+				continue
+			}
+			break
+		}
+		if len(packet) < offset {
+			return false
+		}
+		tuple.protocol = next
+		payload = packet[offset:]
+
+	default:
+		return false
+	}
+
+	switch tuple.protocol {
+	case protocolTCP, protocolUDP:
+		if len(payload) < 4 {
+			return false
+		}
+		tuple.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		tuple.dstPort = binary.BigEndian.Uint16(payload[2:4])
+		if tuple.protocol == protocolTCP && len(payload) >= 14 {
+			tuple.tcpFlags = payload[13]
+		}
+
+	case protocolICMPv4, protocolICMPv6:
+		if (tuple.protocol == protocolICMPv4) != (tuple.version == ipv4.Version) {
+			return false
+		}
+		if len(payload) < 8 {
+			return false
+		}
+		tuple.icmpType = payload[0]
+		if icmpIsEchoRequest(tuple.version, tuple.icmpType) || icmpIsEchoReply(tuple.version, tuple.icmpType) {
+			tuple.srcPort = binary.BigEndian.Uint16(payload[4:6])
+			tuple.dstPort = tuple.srcPort
+		} else if icmpIsError(tuple.version, tuple.icmpType) {
+			tuple.embedded = payload[8:]
+		}
+	}
+
+	return true
+}
+
+func (tuple *conntrackTuple) outboundKey() conntrackKey {
+	return conntrackKey{
+		version:    tuple.version,
+		protocol:   tuple.protocol,
+		localPort:  tuple.srcPort,
+		remotePort: tuple.dstPort,
+		local:      tuple.src,
+		remote:     tuple.dst,
+	}
+}
+
+func (tuple *conntrackTuple) inboundKey() conntrackKey {
+	return conntrackKey{
+		version:    tuple.version,
+		protocol:   tuple.protocol,
+		localPort:  tuple.dstPort,
+		remotePort: tuple.srcPort,
+		local:      tuple.dst,
+		remote:     tuple.src,
+	}
+}
+
+func (flow *conntrackFlow) refresh(protocol uint8, now time.Time) {
+	timeout := ConntrackUnrepliedTimeout
+	if flow.replied {
+		switch protocol {
+		case protocolTCP:
+			timeout = ConntrackTCPTimeout
+			if flow.closing {
+				timeout = ConntrackTCPClosingTimeout
+			}
+		case protocolUDP:
+			timeout = ConntrackUDPTimeout
+		case protocolICMPv4, protocolICMPv6:
+			timeout = ConntrackICMPTimeout
+		default:
+			timeout = ConntrackOtherTimeout
+		}
+	}
+	flow.expires = now.Add(timeout)
+}
+
+func (flow *conntrackFlow) updateTCP(flags uint8) {
+	if flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+		flow.closing = true
+	}
+}
+
+/* Configures whether the peer may only answer flows started from the TUN side
+ */
+func (peer *Peer) SetRestrictInbound(restrict bool) {
+	peer.conntrack.Lock()
+	defer peer.conntrack.Unlock()
+	peer.conntrack.restricted.Set(restrict)
+	if !restrict {
+		peer.conntrack.flows = nil
+	}
+}
+
+/* Must hold peer.conntrack.Mutex
+ */
+func (peer *Peer) unsafeConntrackSweep(now time.Time) {
+	for key, flow := range peer.conntrack.flows {
+		if now.After(flow.expires) {
+			delete(peer.conntrack.flows, key)
+		}
+	}
+	peer.conntrack.lastSweep = now
+}
+
+/* Tracks a packet sent to the peer
+ */
+func (peer *Peer) conntrackOutbound(packet []byte) {
+	var tuple conntrackTuple
+	if !tuple.parse(packet) || tuple.fragment {
+		return
+	}
+	if (tuple.protocol == protocolICMPv4 || tuple.protocol == protocolICMPv6) &&
+		!icmpIsEchoRequest(tuple.version, tuple.icmpType) {
+		return
+	}
+
+	key := tuple.outboundKey()
+	now := time.Now()
+
+	peer.conntrack.Lock()
+	defer peer.conntrack.Unlock()
+
+	if !peer.conntrack.restricted.Get() {
+		return
+	}
+
+	if now.Sub(peer.conntrack.lastSweep) > ConntrackSweepInterval {
+		peer.unsafeConntrackSweep(now)
+	}
+
+	flow, ok := peer.conntrack.flows[key]
+	if !ok || now.After(flow.expires) {
+		if !ok && len(peer.conntrack.flows) >= ConntrackMaxFlows {
+			peer.unsafeConntrackSweep(now)
+			if len(peer.conntrack.flows) >= ConntrackMaxFlows {
+				peer.device.log.Debug.Println(peer, "- Connection tracking table full")
+				return
+			}
+		}
+		if peer.conntrack.flows == nil {
+			peer.conntrack.flows = make(map[conntrackKey]conntrackFlow)
+		}
+		flow = conntrackFlow{}
+	}
+	if tuple.protocol == protocolTCP {
+		if tuple.tcpFlags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN {
+			flow = conntrackFlow{} // connection reopened
+		}
+		flow.updateTCP(tuple.tcpFlags)
+	}
+	flow.refresh(tuple.protocol, now)
+	peer.conntrack.flows[key] = flow
+}
+
+/* Checks whether a packet received from the peer belongs to a tracked flow,
+ * returns false if the packet should be dropped
+ */
+func (peer *Peer) conntrackInbound(packet []byte) bool {
+	var tuple conntrackTuple
+	if !tuple.parse(packet) {
+		return false
+	}
+	if tuple.fragment {
+		return true
+	}
+
+	now := time.Now()
+
+	peer.conntrack.Lock()
+	defer peer.conntrack.Unlock()
+
+	if !peer.conntrack.restricted.Get() {
+		return true
+	}
+
+	if tuple.protocol == protocolICMPv4 || tuple.protocol == protocolICMPv6 {
+		if icmpIsError(tuple.version, tuple.icmpType) {
+
+			// errors are related to the quoted packet, which was sent by us
+
+			var quoted conntrackTuple
+			if !quoted.parse(tuple.embedded) || quoted.fragment || quoted.version != tuple.version {
+				return false
+			}
+			flow, ok := peer.conntrack.flows[quoted.outboundKey()]
+			return ok && !now.After(flow.expires)
+		}
+		if !icmpIsEchoReply(tuple.version, tuple.icmpType) {
+			return false
+		}
+	}
+
+	key := tuple.inboundKey()
+	flow, ok := peer.conntrack.flows[key]
+	if !ok || now.After(flow.expires) {
+		return false
+	}
+	flow.replied = true
+	if tuple.protocol == protocolTCP {
+		flow.updateTCP(tuple.tcpFlags)
+	}
+	flow.refresh(tuple.protocol, now)
+	peer.conntrack.flows[key] = flow
+	return true
+}
+
+func (key *conntrackKey) String() string {
+	var local, remote net.IP
+	if key.version == ipv4.Version {
+		local, remote = net.IP(key.local[:net.IPv4len]), net.IP(key.remote[:net.IPv4len])
+	} else {
+		local, remote = net.IP(key.local[:]), net.IP(key.remote[:])
+	}
+
+	switch key.protocol {
+	case protocolTCP:
+		return fmt.Sprintf("tcp %s:%d %s:%d", local, key.localPort, remote, key.remotePort)
+	case protocolUDP:
+		return fmt.Sprintf("udp %s:%d %s:%d", local, key.localPort, remote, key.remotePort)
+	case protocolICMPv4, protocolICMPv6:
+		return fmt.Sprintf("icmp %s %s id=%d", local, remote, key.localPort)
+	default:
+		return fmt.Sprintf("proto=%d %s %s", key.protocol, local, remote)
+	}
+}
+
+/* Returns a description of the tracked flows of the peer,
+ * one per line, for debugging
+ */
+func (peer *Peer) conntrackDump() []string {
+	now := time.Now()
+
+	peer.conntrack.Lock()
+	defer peer.conntrack.Unlock()
+
+	lines := make([]string, 0, len(peer.conntrack.flows))
+	for key, flow := range peer.conntrack.flows {
+		if now.After(flow.expires) {
+			continue
+		}
+		state := "unreplied"
+		if flow.closing {
+			state = "closing"
+		} else if flow.replied {
+			state = "replied"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s expires=%d", key.String(), state, flow.expires.Sub(now)/time.Second))
+	}
+	sort.Strings(lines)
+	return lines
+}
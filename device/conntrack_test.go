@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+/* Builds an IPv4 packet with a transport header,
+ * ports are the echo identifier for ICMP
+ */
+func conntrackTestPacket(protocol uint8, src, dst string, srcPort, dstPort uint16, flags uint8) []byte {
+	packet := make([]byte, 20+20)
+	packet[0] = (4 << 4) | 5
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[IPv4offsetSrc:], net.ParseIP(src).To4())
+	copy(packet[IPv4offsetDst:], net.ParseIP(dst).To4())
+
+	transport := packet[20:]
+	if protocol == protocolICMPv4 {
+		transport[0] = flags // type
+		binary.BigEndian.PutUint16(transport[4:], srcPort)
+	} else {
+		binary.BigEndian.PutUint16(transport[0:], srcPort)
+		binary.BigEndian.PutUint16(transport[2:], dstPort)
+		transport[13] = flags
+	}
+	return packet
+}
+
+/* Builds an ICMPv4 error quoting the first 28 bytes of a packet
+ */
+func conntrackTestICMPError(src, dst string, quoted []byte) []byte {
+	packet := conntrackTestPacket(protocolICMPv4, src, dst, 0, 0, 3)
+	packet = append(packet[:28], quoted[:28]...)
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	return packet
+}
+
+func TestConntrack(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	peer := &Peer{device: device}
+
+	const local, remote = "10.0.0.1", "10.0.0.2"
+
+	udpOut := conntrackTestPacket(protocolUDP, local, remote, 5000, 53, 0)
+	udpReply := conntrackTestPacket(protocolUDP, remote, local, 53, 5000, 0)
+	udpOtherPort := conntrackTestPacket(protocolUDP, remote, local, 54, 5000, 0)
+	tcpSyn := conntrackTestPacket(protocolTCP, remote, local, 40000, 22, tcpFlagSYN)
+	tcpSynOut := conntrackTestPacket(protocolTCP, local, remote, 40001, 443, tcpFlagSYN)
+	tcpSynAck := conntrackTestPacket(protocolTCP, remote, local, 443, 40001, tcpFlagSYN|tcpFlagACK)
+	echoRequest := conntrackTestPacket(protocolICMPv4, local, remote, 7, 7, 8)
+	echoReply := conntrackTestPacket(protocolICMPv4, remote, local, 7, 7, 0)
+	echoRequestIn := conntrackTestPacket(protocolICMPv4, remote, local, 8, 8, 8)
+	errorTracked := conntrackTestICMPError(remote, local, udpOut)
+	errorUntracked := conntrackTestICMPError(remote, local, conntrackTestPacket(protocolUDP, local, remote, 5001, 53, 0))
+
+	// unrestricted peers accept everything
+
+	if !peer.conntrackInbound(tcpSyn) {
+		t.Fatal("unrestricted peer rejected inbound flow")
+	}
+
+	peer.SetRestrictInbound(true)
+
+	for _, packet := range [][]byte{udpReply, tcpSyn, tcpSynAck, echoReply, echoRequestIn, errorTracked} {
+		if peer.conntrackInbound(packet) {
+			t.Fatal("restricted peer accepted untracked packet")
+		}
+	}
+
+	peer.conntrackOutbound(udpOut)
+	peer.conntrackOutbound(tcpSynOut)
+	peer.conntrackOutbound(echoRequest)
+
+	for _, packet := range [][]byte{udpReply, tcpSynAck, echoReply, errorTracked} {
+		if !peer.conntrackInbound(packet) {
+			t.Fatal("restricted peer rejected packet of tracked flow")
+		}
+	}
+	for _, packet := range [][]byte{udpOtherPort, tcpSyn, echoRequestIn, errorUntracked} {
+		if peer.conntrackInbound(packet) {
+			t.Fatal("restricted peer accepted packet of untracked flow")
+		}
+	}
+
+	dump := strings.Join(peer.conntrackDump(), "\n")
+	for _, flow := range []string{
+		"udp 10.0.0.1:5000 10.0.0.2:53 replied",
+		"tcp 10.0.0.1:40001 10.0.0.2:443 replied",
+		"icmp 10.0.0.1 10.0.0.2 id=7 replied",
+	} {
+		if !strings.Contains(dump, flow) {
+			t.Fatal("flow", flow, "missing from dump:\n"+dump)
+		}
+	}
+
+	// closing connections are tracked until they expire
+
+	peer.conntrackOutbound(conntrackTestPacket(protocolTCP, local, remote, 40001, 443, tcpFlagFIN|tcpFlagACK))
+	if !strings.Contains(strings.Join(peer.conntrackDump(), "\n"), "tcp 10.0.0.1:40001 10.0.0.2:443 closing") {
+		t.Fatal("FIN not tracked")
+	}
+
+	peer.SetRestrictInbound(false)
+	if len(peer.conntrackDump()) != 0 {
+		t.Fatal("flows retained after lifting restriction")
+	}
+}
+
+func TestConntrackIPv6ExtensionHeaders(t *testing.T) {
+	packet := make([]byte, 40+8+8)
+	packet[0] = 6 << 4
+	packet[6] = 0 // hop-by-hop options
+	copy(packet[IPv6offsetSrc:], net.ParseIP("fd00::1"))
+	copy(packet[IPv6offsetDst:], net.ParseIP("fd00::2"))
+	packet[40] = protocolUDP
+	binary.BigEndian.PutUint16(packet[48:], 1234)
+	binary.BigEndian.PutUint16(packet[50:], 53)
+
+	var tuple conntrackTuple
+	if !tuple.parse(packet) {
+		t.Fatal("failed to parse IPv6 packet")
+	}
+	if tuple.protocol != protocolUDP || tuple.srcPort != 1234 || tuple.dstPort != 53 {
+		t.Fatal("extension headers not skipped:", tuple.protocol, tuple.srcPort, tuple.dstPort)
+	}
+	if tuple.parse(packet[:45]) {
+		t.Fatal("parsed truncated packet")
+	}
+}
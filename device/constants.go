@@ -38,4 +38,91 @@ const (
 	UnderLoadQueueSize = QueueHandshakeSize / 8
 	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
 	MaxPeers           = 1 << 16     // maximum number of configured peers
+	SchedulerQuantum   = 1 << 12     // bytes released per peer and round of the scheduler
+)
+
+const (
+	EndpointFailoverAttempts = 3                // failed handshake attempts before moving to the next candidate endpoint
+	EndpointProbeInterval    = time.Second * 60 // initial interval of handshakes with the preferred endpoint, while using a fallback
+	EndpointProbeMaxInterval = time.Minute * 16 // interval the probes back off to, while the preferred endpoint does not respond
+)
+
+/* Capture constants */
+
+const (
+	CaptureBufferSize    = 1 << 16     // bytes of captured packets buffered before writing
+	CaptureFlushInterval = time.Second // longest time captured packets stay buffered
+)
+
+/* Connection tracking constants */
+
+const (
+	ConntrackMaxFlows          = 1 << 12 // maximum number of tracked flows per peer
+	ConntrackSweepInterval     = time.Second * 30
+	ConntrackUnrepliedTimeout  = time.Second * 30
+	ConntrackTCPTimeout        = time.Hour * 2
+	ConntrackTCPClosingTimeout = time.Second * 120
+	ConntrackUDPTimeout        = time.Second * 180
+	ConntrackICMPTimeout       = time.Second * 30
+	ConntrackOtherTimeout      = time.Second * 600
+)
+
+/* Traffic shaping constants */
+
+const (
+	ShapingMaxQueueDelay    = time.Millisecond * 250 // longest delay of a queued packet, before it is dropped
+	ShapingDefaultBurstTime = time.Millisecond * 100 // default bucket size, in time at the configured rate
+	ShapingMinBurst         = 2 * MaxMessageSize     // smallest default bucket size in bytes
+)
+
+/* Stream transport constants */
+
+const (
+	StreamDialTimeout    = time.Second * 5 // timeout of connecting to the endpoint of a peer, and of the first message of accepted connections
+	StreamWriteTimeout   = time.Second * 5 // timeout of writing a message, before the connection is closed
+	StreamIdleTimeout    = time.Minute * 3 // connections without received message for this long are closed
+	StreamDialMinBackoff = time.Second     // delay of dialing an endpoint again, after a failed dial
+	StreamDialMaxBackoff = time.Minute     // longest delay of dialing an endpoint again
+	StreamMaxConnections = 256             // maximum number of connections of a stream bind
+)
+
+/* Obfuscation constants */
+
+const (
+	ObfuscationMinPadding     = 16   // smallest random padding of handshake messages
+	ObfuscationMaxPadding     = 128  // largest random padding of handshake messages
+	ObfuscationJunkMinSize    = 32   // smallest junk datagram
+	ObfuscationJunkMaxSize    = 1024 // largest junk datagram
+	ObfuscationMaxJunkPackets = 16   // most junk datagrams before a handshake initiation
+)
+
+/* Privacy constants */
+
+const (
+	ChaffMinInterval = time.Millisecond * 10 // shortest interval of chaff keepalives
+)
+
+/* STUN constants */
+
+const (
+	STUNRetransmitTimeout = time.Millisecond * 500 // wait for a response before retransmitting a binding request
+	STUNAttempts          = 3                      // binding requests sent to each server
+)
+
+/* Automatic keepalive constants */
+
+const (
+	KeepaliveAutoMinInterval = 15  // seconds, the interval learning starts with
+	KeepaliveAutoMaxInterval = 180 // seconds, longest learned interval
+	KeepaliveAutoTrials      = 3   // keepalives after idling for the interval, before increasing it
+
+	KeepaliveAutoLossWindow = RekeyTimeout         // responses stopped due to a lost mapping if a handshake succeeds within
+	KeepaliveAutoRelearn    = RejectAfterTime * 20 // after settling, learning resumes
+)
+
+/* Hole punching constants */
+
+const (
+	PunchInterval = time.Millisecond * 500 // spacing of the rounds of initiations to the candidates
+	PunchAttempts = 20                     // rounds before giving up
 )
@@ -6,6 +6,10 @@
 package device
 
 import (
+	"bufio"
+	"io"
+	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -17,7 +21,7 @@ import (
 
 const (
 	DeviceRoutineNumberPerCPU     = 3
-	DeviceRoutineNumberAdditional = 2
+	DeviceRoutineNumberAdditional = 3
 )
 
 type Device struct {
@@ -39,9 +43,21 @@ type Device struct {
 		starting sync.WaitGroup
 		stopping sync.WaitGroup
 		sync.RWMutex
-		bind   Bind   // bind interface
-		port   uint16 // listening port
-		fwmark uint32 // mark value (0 = disabled)
+		bind            Bind              // bind interface
+		port            uint16            // listening port
+		fwmark          uint32            // mark value (0 = disabled)
+		listenAddr4     net.IP            // local IPv4 address to listen on (nil = any)
+		listenAddr6     net.IP            // local IPv6 address to listen on (nil = any)
+		bindInterface   string            // interface the sockets are bound to (empty = any)
+		extraPorts      []uint16          // additional listening ports
+		extraBinds      []Bind            // binds of the additional ports
+		socketHook      SocketHook        // called with the sockets of new binds
+		rcvbuf          int               // socket receive buffer size (0 = system default)
+		sndbuf          int               // socket send buffer size (0 = system default)
+		drops           uint64            // datagrams dropped by the kernel on closed binds
+		transport       Transport         // transport of the binds (nil = UDP)
+		obfuscationKey  NoiseSymmetricKey // key obfuscating messages on the wire (zero = disabled)
+		obfuscationJunk int               // junk datagrams before each handshake initiation
 	}
 
 	staticIdentity struct {
@@ -66,9 +82,10 @@ type Device struct {
 		limiter        ratelimiter.Ratelimiter
 	}
 
+	filter atomic.Value // packetFilterHolder
+
 	pool struct {
-		messageBufferPool        *sync.Pool
-		messageBufferReuseChan   chan *[MaxMessageSize]byte
+		messageBuffers           []messageBufferPool
 		inboundElementPool       *sync.Pool
 		inboundElementReuseChan  chan *QueueInboundElement
 		outboundElementPool      *sync.Pool
@@ -81,6 +98,13 @@ type Device struct {
 		handshake  chan QueueHandshakeElement
 	}
 
+	scheduler struct {
+		sync.Mutex
+		head   *Peer // round of peers with staged elements, linked by peer.scheduler.next
+		tail   *Peer
+		signal chan struct{} // size 1, peer added to empty round
+	}
+
 	signals struct {
 		stop chan struct{}
 	}
@@ -89,6 +113,40 @@ type Device struct {
 		device tun.Device
 		mtu    int32
 	}
+
+	capture struct {
+		sync.Mutex
+		enabled  AtomicBool      // checked before taking the lock
+		file     *os.File        // destination of the capture (nil = disabled)
+		path     string          // path of the capture file
+		buffered *bufio.Writer   // buffer in front of file
+		writer   *pcapngWriter   // writer for buffered
+		stop     chan struct{}   // stops flushing the buffer
+		peer     *NoisePublicKey // only capture packets of this peer (nil = all)
+		maxSize  int64           // stop capturing at this file size (0 = unlimited)
+	}
+
+	keyLog struct {
+		sync.Mutex
+		enabled     AtomicBool      // checked before taking the lock
+		writer      io.Writer       // destination of logged secrets (nil = disabled)
+		localStatic NoisePrivateKey // copy of the static private key, while enabled
+	}
+
+	stun struct {
+		awaiting AtomicBool // requests are pending, received datagrams are checked for responses
+		sync.Mutex
+		servers    []string                                    // STUN servers (host:port)
+		handler    func(STUNResult)                            // called with the result of every discovery
+		generation uint64                                      // discovery in progress, superseded ones stop
+		pending    map[[stunTransactionIDSize]byte]stunRequest // requests awaiting a response, by transaction id
+		mapped     []*net.UDPAddr                              // address mapped by each server (nil = no answer yet)
+		result     STUNResult                                  // result of the last discovery
+	}
+
+	relay struct {
+		server atomic.Value // *net.UDPAddr of the relay server (nil = disabled)
+	}
 }
 
 /* Converts the peer into a "zombie", which remains in the peer map,
@@ -140,7 +198,7 @@ func deviceUpdateState(device *Device) {
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
 			peer.Start()
-			if peer.persistentKeepaliveInterval > 0 {
+			if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
 				peer.SendKeepalive()
 			}
 		}
@@ -233,6 +291,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.staticIdentity.privateKey = sk
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
+	device.unsafeKeyLogUpdateStatic(sk)
 
 	// do static-static DH pre-computations
 
@@ -288,6 +347,7 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 	// prepare signals
 
 	device.signals.stop = make(chan struct{})
+	device.scheduler.signal = make(chan struct{}, 1)
 
 	// prepare net
 
@@ -307,6 +367,7 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 		go device.RoutineHandshake()
 	}
 
+	go device.RoutineScheduler()
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
 
@@ -357,6 +418,7 @@ func (device *Device) FlushPacketQueues() {
 			}
 		case <-device.queue.handshake:
 		default:
+			device.flushScheduledPeers()
 			return
 		}
 	}
@@ -377,6 +439,7 @@ func (device *Device) Close() {
 
 	device.tun.device.Close()
 	device.BindClose()
+	device.StopCapture()
 
 	device.isUp.Set(false)
 
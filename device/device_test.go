@@ -80,6 +80,78 @@ endpoint=127.0.0.1:53511`
 	})
 }
 
+func TestAdditionalListenPort(t *testing.T) {
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53521
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:53523`
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second device is only reachable on its additional port
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53522
+additional_listen_port=53523
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	var config bytes.Buffer
+	writer := bufio.NewWriter(&config)
+	if err := dev2.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(config.String(), "additional_listen_port=53523\n") {
+		t.Fatal("additional port not reported:", config.String())
+	}
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(300 * time.Millisecond):
+			t.Fatal("ping to", p.dst, "did not transit")
+		}
+	}
+
+	// replies leave from the port the peer used
+
+	peer := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer.RLock()
+	endpoint := peer.endpoint.DstToString()
+	peer.RUnlock()
+	assertEquals(t, endpoint, "127.0.0.1:53523")
+}
+
 func ping(dst, src net.IP) []byte {
 	localPort := uint16(1337)
 	seq := uint16(0)
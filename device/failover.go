@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"time"
+)
+
+/* Candidate endpoints of a peer, for sites with backup uplinks.
+ *
+ * The configured endpoint is preferred, followed by the fallback endpoints in priority order.
+ * After EndpointFailoverAttempts failed handshake attempts the peer moves on to the next candidate.
+ * While using a fallback, handshakes are sent to the preferred endpoint, returning to it once it responds.
+ * The probes start after EndpointProbeInterval and back off up to EndpointProbeMaxInterval,
+ * since every one of them is a full handshake initiation, replacing the session on the fallback once answered.
+ * With relay fallback a relay endpoint is the last candidate, after the fallback endpoints.
+ * Setting the endpoint replaces the preferred one only, the fallbacks are removed explicitly.
+ */
+
+/* Sets the preferred endpoint of the peer, keeping the fallbacks
+ *
+ * Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeSetPreferredEndpoint(endpoint Endpoint) {
+	peer.endpoint = endpoint
+	peer.endpointBind = nil
+	peer.endpoints.active = 0
+	switch {
+	case len(peer.endpoints.candidates) == 0:
+		peer.endpoints.candidates = []Endpoint{endpoint}
+	case peer.endpoints.relay && len(peer.endpoints.candidates) == 1:
+		peer.endpoints.candidates = append([]Endpoint{endpoint}, peer.endpoints.candidates...)
+	default:
+		peer.endpoints.candidates[0] = endpoint
+	}
+}
+
+/* Removes the fallbacks, keeping the preferred and relay endpoints
+ *
+ * Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeRemoveFallbackEndpoints() {
+	candidates := peer.endpoints.candidates
+	last := len(candidates) - 1
+	if peer.endpoints.relay {
+		last--
+	}
+	if last < 1 {
+		return
+	}
+
+	active := peer.endpoints.active
+	peer.endpoints.candidates = append(candidates[:1], candidates[last+1:]...)
+	switch {
+	case active > last:
+		peer.endpoints.active = len(peer.endpoints.candidates) - 1
+	case active > 0:
+		peer.endpoints.active = 0
+		peer.endpoint = peer.endpoints.candidates[0]
+		peer.endpointBind = nil
+	}
+}
+
+/* Appends a fallback to the candidate endpoints of the peer
+ *
+ * Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeAddFallbackEndpoint(endpoint Endpoint) {
+
+	// repeated configurations add a fallback once
+
+	if _, ok := endpoint.(*RelayEndpoint); !ok {
+		for _, candidate := range peer.endpoints.candidates {
+			if _, ok := candidate.(*RelayEndpoint); !ok && bytes.Equal(candidate.DstToBytes(), endpoint.DstToBytes()) {
+				return
+			}
+		}
+	}
+	if len(peer.endpoints.candidates) == 0 && peer.endpoint != nil {
+		peer.endpoints.candidates = append(peer.endpoints.candidates, peer.endpoint)
+	}
+	if last := len(peer.endpoints.candidates) - 1; peer.endpoints.relay && last >= 0 {
+
+		// the relay endpoint remains the last resort
+
+		relay := peer.endpoints.candidates[last]
+		peer.endpoints.candidates = append(peer.endpoints.candidates[:last], endpoint, relay)
+		switch {
+		case last == 0:
+			peer.endpoint = endpoint
+			peer.endpointBind = nil
+			peer.endpoints.active = 0
+		case peer.endpoints.active == last:
+			peer.endpoints.active++
+		}
+	} else {
+		peer.endpoints.candidates = append(peer.endpoints.candidates, endpoint)
+	}
+	if peer.endpoint == nil {
+		peer.endpoint = peer.endpoints.candidates[0]
+	}
+}
+
+func (peer *Peer) unsafePreferredEndpoint() Endpoint {
+	if len(peer.endpoints.candidates) == 0 {
+		return peer.endpoint
+	}
+	return peer.endpoints.candidates[0]
+}
+
+func (peer *Peer) unsafeFallbackEndpoints() []Endpoint {
+	if len(peer.endpoints.candidates) < 2 {
+		return nil
+	}
+	return peer.endpoints.candidates[1:]
+}
+
+/* Moves to the next candidate endpoint, wrapping around to the preferred one
+ */
+func (peer *Peer) failoverEndpoint() {
+	peer.Lock()
+	defer peer.Unlock()
+
+	candidates := peer.endpoints.candidates
+	if len(candidates) < 2 {
+		return
+	}
+
+	peer.endpoints.active = (peer.endpoints.active + 1) % len(candidates)
+	peer.endpoint = candidates[peer.endpoints.active]
+	peer.endpointBind = nil
+	peer.endpoint.ClearSrc()
+
+	peer.device.log.Info.Println(peer, "- Failing over to endpoint", peer.endpoint.DstToString())
+
+	// probe again early, the failover shows the connectivity changed
+
+	peer.endpoints.probeInterval = EndpointProbeInterval
+	if peer.timersActive() {
+		if peer.endpoints.active == 0 {
+			peer.timers.probeEndpoint.Del()
+		} else if !peer.timers.probeEndpoint.IsPending() {
+			peer.timers.probeEndpoint.Mod(EndpointProbeInterval)
+		}
+	}
+}
+
+/* Returns the preferred endpoint to probe, nil if in use,
+ * and the interval until the following probe, backing off
+ */
+func (peer *Peer) nextEndpointProbe() (Endpoint, time.Duration) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.endpoints.active == 0 {
+		return nil, 0
+	}
+	interval := peer.endpoints.probeInterval * 2
+	if interval < EndpointProbeInterval {
+		interval = EndpointProbeInterval
+	} else if interval > EndpointProbeMaxInterval {
+		interval = EndpointProbeMaxInterval
+	}
+	peer.endpoints.probeInterval = interval
+	return peer.endpoints.candidates[0], interval
+}
+
+/* Returns to the preferred endpoint, if a handshake message arrived from it while using a fallback
+ */
+func (peer *Peer) endpointCandidateReached(endpoint Endpoint, bind Bind) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.endpoints.active == 0 {
+		return
+	}
+
+	preferred := peer.endpoints.candidates[0]
+	if !bytes.Equal(endpoint.DstToBytes(), preferred.DstToBytes()) {
+		return
+	}
+
+	peer.endpoint = endpoint
+	peer.endpointBind = bind
+	peer.endpoints.active = 0
+
+	peer.device.log.Info.Println(peer, "- Returning to preferred endpoint", endpoint.DstToString())
+
+	if peer.timersActive() {
+		peer.timers.probeEndpoint.Del()
+	}
+}
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointFailover(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	peer := &Peer{device: device}
+
+	endpoint := func(s string) Endpoint {
+		endpoint, err := CreateEndpoint(s)
+		assertNil(t, err)
+		return endpoint
+	}
+	active := func() string {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+
+	// a single endpoint never fails over
+
+	peer.Lock()
+	peer.unsafeSetPreferredEndpoint(endpoint("192.0.2.1:51820"))
+	peer.Unlock()
+	peer.failoverEndpoint()
+	if active() != "192.0.2.1:51820" {
+		t.Fatal("failed over without fallbacks")
+	}
+
+	peer.Lock()
+	peer.unsafeAddFallbackEndpoint(endpoint("198.51.100.1:51820"))
+	peer.unsafeAddFallbackEndpoint(endpoint("[2001:db8::1]:51820"))
+	peer.Unlock()
+
+	for _, expected := range []string{"198.51.100.1:51820", "[2001:db8::1]:51820", "192.0.2.1:51820", "198.51.100.1:51820"} {
+		peer.failoverEndpoint()
+		if active() != expected {
+			t.Fatal("expected failover to", expected, "got", active())
+		}
+	}
+
+	// probes of the preferred endpoint back off, until the next failover
+
+	for _, expected := range []time.Duration{2 * EndpointProbeInterval, 4 * EndpointProbeInterval, 8 * EndpointProbeInterval, 16 * EndpointProbeInterval, EndpointProbeMaxInterval} {
+		preferred, interval := peer.nextEndpointProbe()
+		if preferred == nil || preferred.DstToString() != "192.0.2.1:51820" || interval != expected {
+			t.Fatal("unexpected probe", preferred, interval)
+		}
+	}
+	peer.failoverEndpoint()
+	peer.failoverEndpoint()
+	peer.failoverEndpoint()
+	if _, interval := peer.nextEndpointProbe(); interval != 2*EndpointProbeInterval {
+		t.Fatal("probes not reset by failover", interval)
+	}
+
+	// handshakes from fallbacks do not change the candidate in use
+
+	peer.endpointCandidateReached(endpoint("[2001:db8::1]:51820"), nil)
+	if peer.endpoints.active != 1 {
+		t.Fatal("fallback treated as preferred endpoint")
+	}
+
+	peer.endpointCandidateReached(endpoint("192.0.2.1:51820"), nil)
+	if peer.endpoints.active != 0 || active() != "192.0.2.1:51820" {
+		t.Fatal("did not return to preferred endpoint")
+	}
+
+	// setting the endpoint replaces the preferred one only, fallbacks are added once
+
+	peer.failoverEndpoint()
+	peer.Lock()
+	peer.unsafeSetPreferredEndpoint(endpoint("192.0.2.2:51820"))
+	peer.unsafeAddFallbackEndpoint(endpoint("198.51.100.1:51820"))
+	fallbacks := peer.unsafeFallbackEndpoints()
+	peer.Unlock()
+	if len(fallbacks) != 2 || active() != "192.0.2.2:51820" || peer.unsafePreferredEndpoint().DstToString() != "192.0.2.2:51820" {
+		t.Fatal("fallbacks not retained when setting endpoint", fallbacks)
+	}
+
+	// replacing the fallbacks removes them, returning to the preferred endpoint
+
+	peer.failoverEndpoint()
+	peer.Lock()
+	peer.unsafeRemoveFallbackEndpoints()
+	fallbacks = peer.unsafeFallbackEndpoints()
+	peer.Unlock()
+	if len(fallbacks) != 0 || active() != "192.0.2.2:51820" {
+		t.Fatal("fallbacks not removed", fallbacks)
+	}
+}
+
+func TestFallbackEndpointWithoutEndpoint(t *testing.T) {
+	peer := &Peer{device: &Device{log: NewLogger(LogLevelError, "")}}
+	fallback, err := CreateEndpoint("198.51.100.1:51820")
+	assertNil(t, err)
+
+	peer.Lock()
+	peer.unsafeAddFallbackEndpoint(fallback)
+	peer.Unlock()
+	if peer.endpoint != fallback || peer.unsafePreferredEndpoint() != fallback {
+		t.Fatal("fallback not used without endpoint")
+	}
+	peer.failoverEndpoint()
+	if peer.endpoint != fallback {
+		t.Fatal("failed over to missing endpoint")
+	}
+}
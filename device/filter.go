@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+type PacketDirection int
+
+const (
+	PacketInbound  PacketDirection = iota // received from a peer, to be written to the TUN device
+	PacketOutbound                        // read from the TUN device, to be sent to a peer
+)
+
+type FilterVerdict int
+
+const (
+	FilterAccept FilterVerdict = iota
+	FilterDrop
+)
+
+/* A PacketFilter enforces policy on the plaintext packets of the tunnel.
+ *
+ * Outbound packets are filtered after routing, before they are queued for encryption,
+ * inbound packets after decryption and source verification, before they are written to the TUN device.
+ *
+ * The filter may rewrite the packet, either in place or by returning a different packet,
+ * which is copied into the buffer of the device.
+ * The filter is called concurrently from several routines and must not retain the packet.
+ */
+type PacketFilter interface {
+	FilterPacket(packet []byte, peer *Peer, direction PacketDirection) ([]byte, FilterVerdict)
+}
+
+type packetFilterHolder struct {
+	filter PacketFilter
+}
+
+/* Sets the packet filter of the device, nil removes the filter
+ */
+func (device *Device) SetPacketFilter(filter PacketFilter) {
+	device.filter.Store(packetFilterHolder{filter})
+}
+
+func (device *Device) packetFilter() PacketFilter {
+	holder, _ := device.filter.Load().(packetFilterHolder)
+	return holder.filter
+}
+
+/* Filters an outbound packet in place,
+ * returns false if the packet should be dropped
+ */
+func (device *Device) filterOutbound(filter PacketFilter, peer *Peer, elem *QueueOutboundElement) bool {
+	packet, verdict := filter.FilterPacket(elem.packet, peer, PacketOutbound)
+	if verdict == FilterAccept && len(packet) > 0 && len(packet) <= MaxContentSize {
+		offset := MessageTransportHeaderSize
+		if needed := outboundBufferSize(len(packet)); needed > len(elem.buffer) {
+			buffer := device.GetMessageBuffer(needed)
+			copy(buffer[offset:], packet)
+			device.PutMessageBuffer(elem.buffer)
+			elem.buffer = buffer
+		} else {
+			copy(elem.buffer[offset:], packet)
+		}
+		elem.packet = elem.buffer[offset : offset+len(packet)]
+		return true
+	}
+	atomic.AddUint64(&peer.stats.txFiltered, 1)
+	return false
+}
+
+/* Filters an inbound packet in place,
+ * returns false if the packet should be dropped
+ */
+func (device *Device) filterInbound(filter PacketFilter, peer *Peer, elem *QueueInboundElement) bool {
+	packet, verdict := filter.FilterPacket(elem.packet, peer, PacketInbound)
+	if verdict == FilterAccept && len(packet) > 0 && len(packet) <= MaxContentSize {
+		offset := MessageTransportOffsetContent
+		if needed := offset + len(packet); needed > len(elem.buffer) {
+			buffer := device.GetMessageBuffer(needed)
+			copy(buffer[offset:], packet)
+			device.PutMessageBuffer(elem.buffer)
+			elem.buffer = buffer
+		} else {
+			copy(elem.buffer[offset:], packet)
+		}
+		elem.packet = elem.buffer[offset : offset+len(packet)]
+		return true
+	}
+	atomic.AddUint64(&peer.stats.rxFiltered, 1)
+	return false
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testPacketFilter func(packet []byte, peer *Peer, direction PacketDirection) ([]byte, FilterVerdict)
+
+func (f testPacketFilter) FilterPacket(packet []byte, peer *Peer, direction PacketDirection) ([]byte, FilterVerdict) {
+	return f(packet, peer, direction)
+}
+
+func TestPacketFilter(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	device.PopulatePools()
+	peer := &Peer{device: device}
+
+	if device.packetFilter() != nil {
+		t.Fatal("packet filter set on new device")
+	}
+
+	packet := ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	large := make([]byte, 1400)
+	copy(large, packet)
+
+	var directions []PacketDirection
+	verdicts := []FilterVerdict{FilterAccept, FilterDrop, FilterAccept}
+	rewrites := [][]byte{nil, nil, large}
+	filter := testPacketFilter(func(p []byte, _ *Peer, direction PacketDirection) ([]byte, FilterVerdict) {
+		i := len(directions) / 2
+		directions = append(directions, direction)
+		if rewrites[i] != nil {
+			return rewrites[i], verdicts[i]
+		}
+		return p, verdicts[i]
+	})
+	device.SetPacketFilter(filter)
+	if device.packetFilter() == nil {
+		t.Fatal("packet filter not set")
+	}
+
+	for i := range verdicts {
+		out := device.NewOutboundElement(len(packet))
+		out.packet = out.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+len(packet)]
+		copy(out.packet, packet)
+
+		in := device.GetInboundElement()
+		in.buffer = device.GetMessageBuffer(MessageTransportOffsetContent + len(packet))
+		in.packet = in.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+len(packet)]
+		copy(in.packet, packet)
+
+		expected := packet
+		if rewrites[i] != nil {
+			expected = rewrites[i]
+		}
+		accepted := verdicts[i] == FilterAccept
+
+		if device.filterOutbound(filter, peer, out) != accepted {
+			t.Fatal("unexpected outbound verdict for packet", i)
+		}
+		if device.filterInbound(filter, peer, in) != accepted {
+			t.Fatal("unexpected inbound verdict for packet", i)
+		}
+		if !accepted {
+			continue
+		}
+
+		if !bytes.Equal(out.packet, expected) || !bytes.Equal(in.packet, expected) {
+			t.Fatal("filtered packet", i, "not preserved")
+		}
+		if &out.packet[0] != &out.buffer[MessageTransportHeaderSize] || len(out.buffer) < outboundBufferSize(len(expected)) {
+			t.Fatal("outbound packet", i, "not placed in its buffer")
+		}
+		if &in.packet[0] != &in.buffer[MessageTransportOffsetContent] {
+			t.Fatal("inbound packet", i, "not placed in its buffer")
+		}
+	}
+
+	for i, direction := range directions {
+		if (i%2 == 0) != (direction == PacketOutbound) {
+			t.Fatal("filter called with wrong direction")
+		}
+	}
+	if peer.stats.txFiltered != 1 || peer.stats.rxFiltered != 1 {
+		t.Fatal("dropped packets not counted:", peer.stats.txFiltered, peer.stats.rxFiltered)
+	}
+
+	device.SetPacketFilter(nil)
+	if device.packetFilter() != nil {
+		t.Fatal("packet filter not removed")
+	}
+}
+
+func TestPacketFilterConfiguration(t *testing.T) {
+	tun := NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	defer dev.Close()
+
+	cfg := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725`
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+		t.Fatal(err)
+	}
+	get := func() string {
+		var config strings.Builder
+		writer := bufio.NewWriter(&config)
+		if err := dev.IpcGetOperation(writer); err != nil {
+			t.Fatal(err)
+		}
+		writer.Flush()
+		return config.String()
+	}
+
+	// the counters are only reported with a filter installed or packets filtered
+
+	if strings.Contains(get(), "_filtered_packets=") {
+		t.Fatal("filtered packets reported without filter")
+	}
+	dev.SetPacketFilter(testPacketFilter(func(p []byte, _ *Peer, _ PacketDirection) ([]byte, FilterVerdict) {
+		return p, FilterAccept
+	}))
+	if config := get(); !strings.Contains(config, "tx_filtered_packets=0\n") || !strings.Contains(config, "rx_filtered_packets=0\n") {
+		t.Fatal("filtered packets not reported with filter")
+	}
+}
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+/* Automatic persistent keepalive interval, learning how long the NAT mappings towards the peer survive idle.
+ *
+ * Starting from KeepaliveAutoMinInterval, the interval grows by half after KeepaliveAutoTrials
+ * persistent keepalives were sent after idling for it, up to KeepaliveAutoMaxInterval.
+ * A lost mapping shows as missing responses (data sent without hearing back) followed by a handshake
+ * with the same endpoint succeeding within KeepaliveAutoLossWindow, unlike a peer which went offline,
+ * or as the peer re-initiating a handshake during a fresh session, as it does once its messages got lost.
+ * The interval then returns to the last one which passed its trials and learning settles there,
+ * losses after settling shorten it further. Learning resumes KeepaliveAutoRelearn after settling,
+ * as the NAT mappings towards the peer may have changed.
+ */
+
+/* Enables learning the persistent keepalive interval, restarting from the shortest interval
+ */
+func (peer *Peer) SetAutoKeepalive(enabled bool) {
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+
+	peer.keepalive.auto = enabled
+	peer.keepalive.settled = false
+	peer.keepalive.safe = 0
+	peer.keepalive.trials = 0
+	peer.keepalive.stopped = nil
+	if enabled {
+		atomic.StoreUint32(&peer.persistentKeepaliveInterval, KeepaliveAutoMinInterval)
+	}
+}
+
+/* Counts a keepalive sent after idling for the interval, increasing it after enough trials
+ */
+func (peer *Peer) keepaliveIdle() {
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+
+	if !peer.keepalive.auto {
+		return
+	}
+	peer.keepalive.trials++
+	if peer.keepalive.settled && time.Since(peer.keepalive.settledAt) >= KeepaliveAutoRelearn {
+		peer.keepalive.settled = false
+		peer.keepalive.trials = 1
+		peer.device.log.Debug.Printf("%s - Resuming learning of persistent keepalive interval\n", peer)
+	}
+	if peer.keepalive.settled || peer.keepalive.trials < KeepaliveAutoTrials {
+		return
+	}
+
+	interval := atomic.LoadUint32(&peer.persistentKeepaliveInterval)
+	peer.keepalive.safe = interval
+	peer.keepalive.trials = 0
+	if interval >= KeepaliveAutoMaxInterval {
+		peer.keepalive.settled = true
+		peer.keepalive.settledAt = time.Now()
+		peer.device.log.Info.Printf("%s - Settled on persistent keepalive interval of %d seconds\n", peer, interval)
+		return
+	}
+
+	next := interval + interval/2
+	if next > KeepaliveAutoMaxInterval {
+		next = KeepaliveAutoMaxInterval
+	}
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, next)
+	peer.device.log.Debug.Printf("%s - Increasing persistent keepalive interval to %d seconds\n", peer, next)
+}
+
+/* Shortens the interval, after a sign that a mapping was lost while idling for it
+ */
+func (peer *Peer) keepaliveMappingLost(reason string) {
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+
+	// losses before idling for the interval are not due to it
+
+	if !peer.keepalive.auto || peer.keepalive.trials == 0 {
+		return
+	}
+
+	interval := atomic.LoadUint32(&peer.persistentKeepaliveInterval)
+	next := peer.keepalive.safe
+	if next == 0 || next >= interval {
+		next = interval * 2 / 3
+		peer.keepalive.safe = 0
+	}
+	if next < KeepaliveAutoMinInterval {
+		next = KeepaliveAutoMinInterval
+	}
+	peer.keepalive.settled = true
+	peer.keepalive.settledAt = time.Now()
+	peer.keepalive.trials = 0
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, next)
+
+	peer.device.log.Info.Printf("%s - Mapping lost after idling for %d seconds (%s), settling on persistent keepalive interval of %d seconds\n", peer, interval, reason, next)
+}
+
+/* Notes that responses stopped from the endpoint, a mapping lost if the following handshake succeeds from it
+ */
+func (peer *Peer) keepaliveResponsesStopped(endpoint Endpoint) {
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+
+	if !peer.keepalive.auto || endpoint == nil {
+		return
+	}
+	peer.keepalive.stopped = append(peer.keepalive.stopped[:0], endpoint.DstToBytes()...)
+	peer.keepalive.stoppedAt = time.Now()
+}
+
+/* Checks a completed handshake for a lost mapping, after responses stopped
+ */
+func (peer *Peer) keepaliveHandshakeComplete(endpoint Endpoint) {
+	peer.keepalive.Lock()
+	stopped := peer.keepalive.stopped
+	lost := stopped != nil && time.Since(peer.keepalive.stoppedAt) < KeepaliveAutoLossWindow &&
+		bytes.Equal(stopped, endpoint.DstToBytes())
+	peer.keepalive.stopped = nil
+	peer.keepalive.Unlock()
+
+	if lost {
+		peer.keepaliveMappingLost("no response from peer")
+	}
+}
+
+/* Checks a handshake initiation of the peer for a re-initiation during a fresh session
+ */
+func (peer *Peer) keepaliveInitiationReceived() {
+	keypair := peer.keypairs.Current()
+	if keypair != nil && time.Since(keypair.created) < RekeyAfterTime {
+		peer.keepaliveMappingLost("handshake re-initiated by peer")
+	}
+}
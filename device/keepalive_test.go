@@ -0,0 +1,178 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutoKeepalive(t *testing.T) {
+	peer := &Peer{device: &Device{log: NewLogger(LogLevelError, "")}}
+	interval := func() uint32 {
+		return atomic.LoadUint32(&peer.persistentKeepaliveInterval)
+	}
+	idle := func(n int) {
+		for i := 0; i < n; i++ {
+			peer.keepaliveIdle()
+		}
+	}
+
+	peer.SetAutoKeepalive(true)
+	if interval() != KeepaliveAutoMinInterval {
+		t.Fatal("learning did not start from the shortest interval", interval())
+	}
+
+	// losses before idling for the interval are ignored
+
+	peer.keepaliveMappingLost("test")
+	if peer.keepalive.settled {
+		t.Fatal("settled without idling")
+	}
+
+	// the interval grows after its trials
+
+	idle(KeepaliveAutoTrials)
+	if interval() != 22 {
+		t.Fatal("interval not increased", interval())
+	}
+	idle(KeepaliveAutoTrials)
+	if interval() != 33 {
+		t.Fatal("interval not increased", interval())
+	}
+
+	// a re-initiation by the peer returns to the last interval which passed
+
+	idle(1)
+	peer.keypairs.current = &Keypair{created: time.Now()}
+	peer.keepaliveInitiationReceived()
+	if interval() != 22 || !peer.keepalive.settled {
+		t.Fatal("did not settle after lost mapping", interval())
+	}
+	idle(2 * KeepaliveAutoTrials)
+	if interval() != 22 {
+		t.Fatal("interval increased after settling", interval())
+	}
+
+	// losses after settling shorten the interval, down to the shortest one
+
+	peer.keepaliveMappingLost("test")
+	if interval() != KeepaliveAutoMinInterval {
+		t.Fatal("interval not shortened", interval())
+	}
+
+	// learning ends at the longest interval
+
+	peer.SetAutoKeepalive(true)
+	for i := 0; i < 100 && !peer.keepalive.settled; i++ {
+		idle(1)
+	}
+	if interval() != KeepaliveAutoMaxInterval {
+		t.Fatal("did not settle on the longest interval", interval())
+	}
+}
+
+func TestAutoKeepaliveConfiguration(t *testing.T) {
+	tun := NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	defer dev.Close()
+
+	cfg := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+persistent_keepalive_interval=auto`
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		var config strings.Builder
+		writer := bufio.NewWriter(&config)
+		if err := dev.IpcGetOperation(writer); err != nil {
+			t.Fatal(err)
+		}
+		writer.Flush()
+		return config.String()
+	}
+	config := get()
+	for _, line := range []string{"persistent_keepalive_interval=auto\n", "persistent_keepalive_learned_interval=15\n"} {
+		if !strings.Contains(config, line) {
+			t.Fatal("missing from configuration:", line)
+		}
+	}
+
+	// applying the configuration again keeps the learned interval
+
+	var publicKey NoisePublicKey
+	assertNil(t, publicKey.FromHex("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"))
+	peer := dev.LookupPeer(publicKey)
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, 22)
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(get(), "persistent_keepalive_learned_interval=22\n") {
+		t.Fatal("learned interval reset by configuration")
+	}
+
+	// a fixed interval ends learning
+
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(
+		"public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\npersistent_keepalive_interval=25\n"))); err != nil {
+		t.Fatal(err)
+	}
+	config = get()
+	if !strings.Contains(config, "persistent_keepalive_interval=25\n") || strings.Contains(config, "persistent_keepalive_learned_interval=") {
+		t.Fatal("learning not ended by fixed interval")
+	}
+}
+
+func TestAutoKeepaliveOutage(t *testing.T) {
+	peer := &Peer{device: &Device{log: NewLogger(LogLevelError, "")}}
+	endpoint := func(s string) Endpoint {
+		endpoint, err := CreateEndpoint(s)
+		assertNil(t, err)
+		return endpoint
+	}
+	interval := func() uint32 {
+		return atomic.LoadUint32(&peer.persistentKeepaliveInterval)
+	}
+
+	peer.SetAutoKeepalive(true)
+	for i := 0; i < KeepaliveAutoTrials+1; i++ {
+		peer.keepaliveIdle()
+	}
+
+	// an outage of the peer is no lost mapping: the handshake comes late, or from elsewhere
+
+	peer.keepaliveResponsesStopped(endpoint("192.0.2.1:51820"))
+	peer.keepalive.stoppedAt = time.Now().Add(-KeepaliveAutoLossWindow)
+	peer.keepaliveHandshakeComplete(endpoint("192.0.2.1:51820"))
+	peer.keepaliveResponsesStopped(endpoint("192.0.2.1:51820"))
+	peer.keepaliveHandshakeComplete(endpoint("198.51.100.1:51820"))
+	if peer.keepalive.settled {
+		t.Fatal("settled after outage of the peer")
+	}
+
+	// a prompt handshake from the same endpoint is
+
+	peer.keepaliveResponsesStopped(endpoint("192.0.2.1:51820"))
+	peer.keepaliveHandshakeComplete(endpoint("192.0.2.1:51820"))
+	if !peer.keepalive.settled || interval() != KeepaliveAutoMinInterval {
+		t.Fatal("did not settle after lost mapping", interval())
+	}
+
+	// learning resumes after a while
+
+	peer.keepalive.settledAt = time.Now().Add(-KeepaliveAutoRelearn)
+	for i := 0; i < KeepaliveAutoTrials; i++ {
+		peer.keepaliveIdle()
+	}
+	if peer.keepalive.settled || interval() <= KeepaliveAutoMinInterval {
+		t.Fatal("learning not resumed", interval())
+	}
+}
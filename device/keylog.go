@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+)
+
+/* Session key logging, for decrypting captured traffic after the fact.
+ *
+ * THIS IS FOR DEBUGGING ONLY: anybody with access to the key log
+ * can decrypt all logged sessions and impersonate this device.
+ *
+ * Whenever a keypair is derived, the secrets of the handshake are written
+ * in the key log format of the Wireshark WireGuard dissector (wg.keylog_file).
+ */
+
+func (device *Device) SetKeyLog(writer io.Writer) {
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+
+	if writer == nil {
+		setZero(device.keyLog.localStatic[:])
+		device.keyLog.writer = nil
+		device.keyLog.enabled.Set(false)
+		return
+	}
+
+	device.log.Error.Println("Session key logging enabled: all tunnel traffic can be decrypted by the holder of the key log (for debugging only)")
+	device.keyLog.localStatic = device.staticIdentity.privateKey
+	device.keyLog.writer = writer
+	device.keyLog.enabled.Set(true)
+}
+
+/* Must hold device.staticIdentity.Mutex
+ */
+func (device *Device) unsafeKeyLogUpdateStatic(sk NoisePrivateKey) {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+	if device.keyLog.writer != nil {
+		device.keyLog.localStatic = sk
+	}
+}
+
+/* Must hold handshake.mutex
+ */
+func (device *Device) keyLogHandshake(handshake *Handshake) {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+
+	if device.keyLog.writer == nil {
+		return
+	}
+
+	var entry bytes.Buffer
+	line := func(label string, key []byte) {
+		entry.WriteString(label)
+		entry.WriteString(" = ")
+		entry.WriteString(base64.StdEncoding.EncodeToString(key))
+		entry.WriteByte('\n')
+	}
+	line("LOCAL_STATIC_PRIVATE_KEY", device.keyLog.localStatic[:])
+	line("REMOTE_STATIC_PUBLIC_KEY", handshake.remoteStatic[:])
+	line("LOCAL_EPHEMERAL_PRIVATE_KEY", handshake.localEphemeral[:])
+	line("PRESHARED_KEY", handshake.presharedKey[:])
+
+	if _, err := device.keyLog.writer.Write(entry.Bytes()); err != nil {
+		device.log.Error.Println("Failed to write key log:", err)
+	}
+}
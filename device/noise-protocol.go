@@ -523,6 +523,12 @@ func (peer *Peer) BeginSymmetricSession() error {
 		return errors.New("invalid state for keypair derivation")
 	}
 
+	// log secrets of the handshake (debugging only)
+
+	if device.keyLog.enabled.Get() {
+		device.keyLogHandshake(handshake)
+	}
+
 	// zero handshake
 
 	setZero(handshake.chainKey[:])
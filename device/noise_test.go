@@ -7,6 +7,7 @@ package device
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"testing"
 )
@@ -45,6 +46,9 @@ func TestNoiseHandshake(t *testing.T) {
 		peer2.handshake.precomputedStaticStatic[:],
 	)
 
+	var keyLog bytes.Buffer
+	dev1.SetKeyLog(&keyLog)
+
 	/* simulate handshake */
 
 	// initiation message
@@ -103,6 +107,8 @@ func TestNoiseHandshake(t *testing.T) {
 
 	t.Log("deriving keys")
 
+	ephemeral := peer2.handshake.localEphemeral
+
 	err = peer1.BeginSymmetricSession()
 	if err != nil {
 		t.Fatal("failed to derive keypair for peer 1", err)
@@ -116,6 +122,19 @@ func TestNoiseHandshake(t *testing.T) {
 	key1 := peer1.keypairs.next
 	key2 := peer2.keypairs.current
 
+	// key log of initiator
+
+	t.Log("check key log")
+
+	encode := base64.StdEncoding.EncodeToString
+	expected := "LOCAL_STATIC_PRIVATE_KEY = " + encode(dev1.staticIdentity.privateKey[:]) + "\n" +
+		"REMOTE_STATIC_PUBLIC_KEY = " + encode(peer2.handshake.remoteStatic[:]) + "\n" +
+		"LOCAL_EPHEMERAL_PRIVATE_KEY = " + encode(ephemeral[:]) + "\n" +
+		"PRESHARED_KEY = " + encode(peer2.handshake.presharedKey[:]) + "\n"
+	if keyLog.String() != expected {
+		t.Fatal("unexpected key log:", keyLog.String())
+	}
+
 	// encrypting / decryption test
 
 	t.Log("test key pairs")
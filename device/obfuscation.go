@@ -0,0 +1,228 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Obfuscation of WireGuard messages on the wire, agreed on by both ends through a shared key.
+ *
+ * The first bytes of every message (type, reserved bytes, indices and counter) are masked
+ * with a keystream derived from the key and the last bytes of the datagram:
+ * the authentication tag of transport messages, random padding appended to handshake messages.
+ * Junk datagrams of random size may precede handshake initiations,
+ * receivers drop them since they unmask to no message type.
+ *
+ * This hides the message types and sizes from passive classification, it provides no confidentiality.
+ */
+
+const (
+	obfuscationMaskSize = 16 // bytes masked at the start of messages
+	obfuscationSeedSize = 16 // bytes at the end of datagrams seeding the mask
+)
+
+type obfuscatedBind struct {
+	Bind
+	device *Device
+	key    NoiseSymmetricKey
+	junk   int // junk datagrams before each handshake initiation
+}
+
+var _ MarkedBind = (*obfuscatedBind)(nil)
+var _ BufferedBind = (*obfuscatedBind)(nil)
+
+/* Wraps the bind with the obfuscation of the device, if enabled
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeObfuscateBind(bind Bind) Bind {
+	if device.net.obfuscationKey == (NoiseSymmetricKey{}) {
+		return bind
+	}
+	return &obfuscatedBind{
+		Bind:   bind,
+		device: device,
+		key:    device.net.obfuscationKey,
+		junk:   device.net.obfuscationJunk,
+	}
+}
+
+/* Sets the key obfuscating messages on the wire (zero disables obfuscation)
+ * and the number of junk datagrams sent before each handshake initiation
+ */
+func (device *Device) SetObfuscation(key NoiseSymmetricKey, junkPackets int) error {
+	if junkPackets < 0 || junkPackets > ObfuscationMaxJunkPackets {
+		return errors.New("invalid number of junk packets")
+	}
+
+	device.net.Lock()
+	device.net.obfuscationKey = key
+	device.net.obfuscationJunk = junkPackets
+	device.net.Unlock()
+
+	return device.BindUpdate()
+}
+
+/* XORs the start of the datagram with the mask seeded by its end
+ */
+func (bind *obfuscatedBind) mask(packet []byte) {
+	var seed [len(NoiseSymmetricKey{}) + obfuscationSeedSize]byte
+	copy(seed[:], bind.key[:])
+	copy(seed[len(bind.key):], packet[len(packet)-obfuscationSeedSize:])
+	mask := blake2s.Sum256(seed[:])
+	for i := 0; i < obfuscationMaskSize; i++ {
+		packet[i] ^= mask[i]
+	}
+}
+
+/* Returns a random number in [min, max]
+ */
+func obfuscationRandom(min, max int) (int, error) {
+	var buff [2]byte
+	if _, err := rand.Read(buff[:]); err != nil {
+		return 0, err
+	}
+	return min + int(binary.LittleEndian.Uint16(buff[:]))%(max-min+1), nil
+}
+
+func (bind *obfuscatedBind) receive(IP int, buff []byte) (int, Endpoint, error) {
+	for {
+		var size int
+		var end Endpoint
+		var err error
+		if IP == ipv4.Version {
+			size, end, err = bind.Bind.ReceiveIPv4(buff)
+		} else {
+			size, end, err = bind.Bind.ReceiveIPv6(buff)
+		}
+		if err != nil {
+			return size, end, err
+		}
+		if isSTUNMessage(buff[:size]) {
+			return size, end, nil // not obfuscated by servers
+		}
+		if size < obfuscationMaskSize+obfuscationSeedSize {
+			continue
+		}
+		bind.mask(buff[:size])
+
+		// strip the padding of handshake messages, drop junk
+
+		var msgSize int
+		switch binary.LittleEndian.Uint32(buff[:4]) {
+		case MessageInitiationType:
+			msgSize = MessageInitiationSize
+		case MessageResponseType:
+			msgSize = MessageResponseSize
+		case MessageCookieReplyType:
+			msgSize = MessageCookieReplySize
+		case MessageTransportType:
+			return size, end, nil
+		default:
+			continue
+		}
+		if size < msgSize+ObfuscationMinPadding {
+			continue
+		}
+		return msgSize, end, nil
+	}
+}
+
+func (bind *obfuscatedBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.receive(ipv4.Version, buff)
+}
+
+func (bind *obfuscatedBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.receive(ipv6.Version, buff)
+}
+
+/* Sends through the wrapped bind, with the mark if non-zero
+ */
+func (bind *obfuscatedBind) sendPacket(packet []byte, end Endpoint, mark uint32) error {
+	if mark != 0 {
+		if marked, ok := bind.Bind.(MarkedBind); ok {
+			return marked.SendWithMark(packet, end, mark)
+		}
+	}
+	return bind.Bind.Send(packet, end)
+}
+
+func (bind *obfuscatedBind) send(msg []byte, end Endpoint, mark uint32) error {
+	if len(msg) < MinMessageSize {
+		return errors.New("message too short to obfuscate")
+	}
+
+	// pad handshake messages, preceding initiations by junk
+
+	padding := 0
+	msgType := binary.LittleEndian.Uint32(msg[:4])
+	if msgType != MessageTransportType {
+		var err error
+		padding, err = obfuscationRandom(ObfuscationMinPadding, ObfuscationMaxPadding)
+		if err != nil {
+			return err
+		}
+	}
+
+	size := len(msg) + padding
+	if msgType == MessageInitiationType && bind.junk > 0 && size < ObfuscationJunkMaxSize {
+		size = ObfuscationJunkMaxSize
+	}
+	buffer := bind.device.GetMessageBuffer(size)
+	defer bind.device.PutMessageBuffer(buffer)
+
+	if msgType == MessageInitiationType {
+		for i := 0; i < bind.junk; i++ {
+			size, err := obfuscationRandom(ObfuscationJunkMinSize, ObfuscationJunkMaxSize)
+			if err != nil {
+				return err
+			}
+			if _, err := rand.Read(buffer[:size]); err != nil {
+				return err
+			}
+			if err := bind.sendPacket(buffer[:size], end, mark); err != nil {
+				return err
+			}
+		}
+	}
+
+	packet := buffer[:len(msg)+padding]
+	copy(packet, msg)
+	if _, err := rand.Read(packet[len(msg):]); err != nil {
+		return err
+	}
+	bind.mask(packet)
+	return bind.sendPacket(packet, end, mark)
+}
+
+func (bind *obfuscatedBind) Send(buff []byte, end Endpoint) error {
+	return bind.send(buff, end, 0)
+}
+
+func (bind *obfuscatedBind) SendWithMark(buff []byte, end Endpoint, mark uint32) error {
+	return bind.send(buff, end, mark)
+}
+
+func (bind *obfuscatedBind) SetBufferSizes(receive, send int) error {
+	if buffered, ok := bind.Bind.(BufferedBind); ok {
+		return buffered.SetBufferSizes(receive, send)
+	}
+	return nil
+}
+
+func (bind *obfuscatedBind) Drops() uint64 {
+	if buffered, ok := bind.Bind.(BufferedBind); ok {
+		return buffered.Drops()
+	}
+	return 0
+}
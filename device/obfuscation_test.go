@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testObfuscationKey = "2a1b27cde1cf7bd8ef4a6c4aec5b1a4aa1fb53d05c6e9c9a0d63e0d36a4cc0ee"
+
+func TestObfuscationWire(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer conn.Close()
+
+	cfg := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+obfuscation_key=` + testObfuscationKey + `
+obfuscation_junk_packets=3
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=` + conn.LocalAddr().String()
+	tun := NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	dev.Up()
+	defer dev.Close()
+	if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+		t.Fatal(err)
+	}
+	tun.Outbound <- ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+
+	// junk precedes the padded initiation, none shows a message type
+
+	bind := &obfuscatedBind{key: dev.net.obfuscationKey}
+	buff := make([]byte, MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 4; i++ {
+		size, _, err := conn.ReadFromUDP(buff)
+		assertNil(t, err)
+		packet := buff[:size]
+		if binary.LittleEndian.Uint32(packet[:4]) == MessageInitiationType {
+			t.Fatal("message type in the clear")
+		}
+		bind.mask(packet)
+		msgType := binary.LittleEndian.Uint32(packet[:4])
+		if i < 3 {
+			if msgType == MessageInitiationType || size < ObfuscationJunkMinSize || size > ObfuscationJunkMaxSize {
+				t.Fatal("expected junk, got datagram of size", size)
+			}
+			continue
+		}
+		if msgType != MessageInitiationType {
+			t.Fatal("expected initiation, got type", msgType)
+		}
+		if size < MessageInitiationSize+ObfuscationMinPadding || size > MessageInitiationSize+ObfuscationMaxPadding {
+			t.Fatal("unexpected size of padded initiation", size)
+		}
+	}
+
+	// the configuration is reported
+
+	var config strings.Builder
+	writer := bufio.NewWriter(&config)
+	if err := dev.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(config.String(), "obfuscation_key="+testObfuscationKey+"\n") ||
+		!strings.Contains(config.String(), "obfuscation_junk_packets=3\n") {
+		t.Fatal("obfuscation missing from configuration")
+	}
+}
+
+func TestObfuscationTransit(t *testing.T) {
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53541
+obfuscation_key=` + testObfuscationKey + `
+obfuscation_junk_packets=2
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:53542`
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53542
+obfuscation_key=` + testObfuscationKey + `
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32
+endpoint=127.0.0.1:53541`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping to", p.dst, "did not transit")
+		}
+	}
+
+	// a zero key disables obfuscation, the peers no longer understand each other
+
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(
+		"obfuscation_key=0000000000000000000000000000000000000000000000000000000000000000\n"))); err != nil {
+		t.Fatal(err)
+	}
+	tun1.Outbound <- ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	select {
+	case <-tun2.Inbound:
+		t.Fatal("ping transited with mismatched obfuscation")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
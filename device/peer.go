@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,13 +26,69 @@ type Peer struct {
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    Endpoint
-	persistentKeepaliveInterval uint16
+	endpointBind                Bind   // bind the endpoint was last reached on (nil = main bind)
+	persistentKeepaliveInterval uint32 // seconds, accessed atomically
 
 	// This must be 64-bit aligned, so make sure the above members come out to even alignment and pad accordingly
 	stats struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		txFiltered        uint64 // outbound packets dropped by the packet filter
+		rxFiltered        uint64 // inbound packets dropped by the packet filter
+		rxRejected        uint64 // inbound packets not belonging to a tracked flow
+		txThrottled       uint64 // outbound bytes delayed or dropped by the rate limit
+		rxThrottled       uint64 // inbound bytes delayed or dropped by the rate limit
+		roamingRejected   uint64 // endpoint changes rejected by the roaming restrictions
+		txPadding         uint64 // bytes of padding to the MTU, beyond the padding multiple
+		txChaff           uint64 // chaff keepalives sent
+	}
+
+	endpoints struct {
+		candidates    []Endpoint    // preferred endpoint followed by fallbacks, in priority order (protected by the peer mutex)
+		active        int           // index of the candidate in use
+		relay         bool          // a relay endpoint follows the fallbacks
+		relayFallback bool          // the relay endpoint is offered while the device relays
+		probeInterval time.Duration // until the next probe of the preferred endpoint
+	}
+
+	fwmark uint32 // firewall mark of datagrams to the peer (0 = mark of the device), accessed atomically
+
+	punch struct {
+		active     AtomicBool // sending initiations to the candidates, until a handshake completes
+		candidates []Endpoint // endpoints punched towards (protected by the peer mutex)
+		rounds     int32      // rounds left before giving up, accessed atomically
+	}
+
+	privacy struct {
+		padToMTU      AtomicBool // pad transport messages to the MTU of the tunnel
+		chaffInterval int64      // interval of chaff keepalives in nanoseconds (0 = disabled), accessed atomically
+		dataSent      AtomicBool // data was sent since the last chaff slot, taking its place
+	}
+
+	keepalive struct {
+		sync.Mutex
+		auto      bool      // learning the persistent keepalive interval
+		settled   bool      // stopped increasing the interval
+		settledAt time.Time // learning resumes KeepaliveAutoRelearn after
+		safe      uint32    // largest interval which passed its trials (0 = none)
+		trials    int       // keepalives sent after idling for the interval, since it last changed
+		stopped   []byte    // endpoint the responses stopped from (nil = responses received)
+		stoppedAt time.Time
+	}
+
+	source struct {
+		pinned  AtomicBool // checked before taking the lock
+		ip4     net.IP     // pinned IPv4 source address (protected by the peer mutex)
+		ip6     net.IP     // pinned IPv6 source address
+		ifindex int32      // pinned egress interface (0 = none)
+	}
+
+	roaming struct {
+		restricted   AtomicBool  // roaming disabled or limited to allowedIPs, checked before taking the lock
+		disabled     bool        // endpoint pinned (protected by the peer mutex)
+		allowedIPs   []net.IPNet // source prefixes roaming is limited to (empty = all)
+		lastRejected []byte      // address of the last logged rejection
 	}
 
 	timers struct {
@@ -40,6 +97,9 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		probeEndpoint           *Timer
+		chaff                   *Timer
+		punch                   *Timer
 		handshakeAttempts       uint32
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
@@ -54,6 +114,7 @@ type Peer struct {
 		nonce                           chan *QueueOutboundElement // nonce / pre-handshake queue
 		outbound                        chan *QueueOutboundElement // sequential ordering of work
 		inbound                         chan *QueueInboundElement  // sequential ordering of work
+		staged                          chan *QueueOutboundElement // awaiting the scheduler, never closed
 		packetInNonceQueueIsAwaitingKey AtomicBool
 	}
 
@@ -64,6 +125,36 @@ type Peer struct {
 		stop       chan struct{}  // size 0, stop all go routines in peer
 	}
 
+	conntrack struct {
+		sync.Mutex
+		restricted AtomicBool                     // peer may only answer tracked flows
+		flows      map[conntrackKey]conntrackFlow // flows started from the TUN side
+		lastSweep  time.Time                      // last removal of expired flows
+	}
+
+	scheduler struct {
+		sync.Mutex                       // held when releasing or flushing staged elements
+		active     AtomicBool            // part of the round of the scheduler
+		next       *Peer                 // next peer of the round
+		head       *QueueOutboundElement // next element, exceeding the deficit
+		deficit    int                   // bytes the peer may release
+	}
+
+	quota struct {
+		sync.Mutex
+		enabled   AtomicBool  // checked before taking the lock
+		tx        peerQuota   // transmit quota, of stats.txBytes
+		rx        peerQuota   // receive quota, of stats.rxBytes
+		period    QuotaPeriod // interval of automatic resets
+		periodEnd time.Time   // next automatic reset (zero = never)
+	}
+
+	shaping struct {
+		queue AtomicBool  // delay packets exceeding the rate instead of dropping them
+		tx    tokenBucket // egress rate limit
+		rx    tokenBucket // ingress rate limit
+	}
+
 	cookieGenerator CookieGenerator
 }
 
@@ -95,6 +186,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
 	peer.isRunning.Set(false)
+	peer.queue.staged = make(chan *QueueOutboundElement, QueueOutboundSize)
 
 	// map public key
 
@@ -143,13 +235,93 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	if peer.source.pinned.Get() {
+		peer.unsafeApplySourcePin(peer.endpoint)
+	}
+
+	err := peer.unsafeSend(buffer, peer.endpoint, peer.device.unsafeReplyBind(peer.endpointBind))
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
 	}
 	return err
 }
 
+func (peer *Peer) sendBufferTo(buffer []byte, endpoint Endpoint) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.net.bind == nil {
+		return errors.New("no bind")
+	}
+
+	if peer.source.pinned.Get() {
+		peer.RLock()
+		peer.unsafeApplySourcePin(endpoint)
+		peer.RUnlock()
+	}
+
+	err := peer.unsafeSend(buffer, endpoint, peer.device.net.bind)
+	if err == nil {
+		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	}
+	return err
+}
+
+/* Sends through the bind with the firewall mark of the peer, if any
+ *
+ * Must hold device.net.RWMutex
+ */
+func (peer *Peer) unsafeSend(buffer []byte, endpoint Endpoint, bind Bind) error {
+	if mark := atomic.LoadUint32(&peer.fwmark); mark != 0 {
+		if marked, ok := bind.(MarkedBind); ok {
+			return marked.SendWithMark(buffer, endpoint, mark)
+		}
+	}
+	return bind.Send(buffer, endpoint)
+}
+
+/* Sets the firewall mark of datagrams to the peer, zero uses the mark of the device,
+ * failing unless the transport is UDP and datagrams can be sent with the mark
+ */
+func (peer *Peer) SetFirewallMark(mark uint32) error {
+	if mark != 0 {
+		peer.device.net.RLock()
+		transport := peer.device.unsafeTransport()
+		peer.device.net.RUnlock()
+		if transport != UDPTransport {
+			return errors.New("per-peer fwmark not supported by transport " + transport.Name())
+		}
+		if err := probeMarkedSend(mark); err != nil {
+			return fmt.Errorf("per-peer fwmark not supported: %v", err)
+		}
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if atomic.SwapUint32(&peer.fwmark, mark) == mark {
+		return nil
+	}
+
+	// routes depend on the mark, clear cached source addresses
+
+	for _, endpoint := range append(peer.endpoints.candidates, peer.endpoint) {
+		if endpoint != nil {
+			endpoint.ClearSrc()
+		}
+	}
+	return nil
+}
+
+/* Returns the mark used for routing datagrams to the peer
+ */
+func (peer *Peer) routingMark(deviceMark uint32) uint32 {
+	if mark := atomic.LoadUint32(&peer.fwmark); mark != 0 {
+		return mark
+	}
+	return deviceMark
+}
+
 func (peer *Peer) String() string {
 	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
 	abbreviatedKey := "invalid"
@@ -206,6 +378,13 @@ func (peer *Peer) Start() {
 
 	peer.routines.starting.Wait()
 	peer.isRunning.Set(true)
+
+	if interval := atomic.LoadInt64(&peer.privacy.chaffInterval); interval > 0 {
+		peer.timers.chaff.Mod(time.Duration(interval))
+	}
+	if peer.punch.active.Get() {
+		peer.timers.punch.Mod(0)
+	}
 }
 
 func (peer *Peer) ZeroAndFlushAll() {
@@ -287,10 +466,21 @@ func (peer *Peer) Stop() {
 var RoamingDisabled bool
 
 func (peer *Peer) SetEndpointFromPacket(endpoint Endpoint) {
+	peer.setEndpointFromPacket(endpoint, nil)
+}
+
+/* Updates the endpoint of the peer and the bind to reply on
+ */
+func (peer *Peer) setEndpointFromPacket(endpoint Endpoint, bind Bind) {
 	if RoamingDisabled {
 		return
 	}
+	if peer.roaming.restricted.Get() {
+		peer.setEndpointRestricted(endpoint, bind)
+		return
+	}
 	peer.Lock()
 	peer.endpoint = endpoint
+	peer.endpointBind = bind
 	peer.Unlock()
 }
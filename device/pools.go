@@ -5,15 +5,105 @@
 
 package device
 
-import "sync"
+import (
+	"sync"
+	"unsafe"
+)
+
+/* Message buffers are handed out from a small number of size classes,
+ * so that a queued keepalive or TCP ACK does not pin down a buffer
+ * large enough to hold the largest possible UDP datagram.
+ *
+ * Every class has its own array type, such that pooled buffers
+ * can be stored in a sync.Pool without additional allocations.
+ *
+ * Where buffers are preallocated, the PreallocatedBuffersPerPool buffers
+ * are split across the classes by their share, rather than preallocated for every class.
+ */
+
+type (
+	messageBufferSmall [MessageBufferSizeSmall]byte
+	messageBufferMTU   [MessageBufferSizeMTU]byte
+	messageBufferMax   [MaxMessageSize]byte
+)
+
+type messageBufferClass struct {
+	size  int
+	share int // of the preallocated buffers, in eighths
+	new   func() interface{}
+	slice func(interface{}) []byte
+	array func([]byte) interface{}
+}
+
+var messageBufferClasses = [...]messageBufferClass{
+	{
+		size:  MessageBufferSizeSmall,
+		share: 4,
+		new:   func() interface{} { return new(messageBufferSmall) },
+		slice: func(b interface{}) []byte { return b.(*messageBufferSmall)[:] },
+		array: func(b []byte) interface{} { return (*messageBufferSmall)(unsafe.Pointer(&b[0])) },
+	},
+	{
+		size:  MessageBufferSizeMTU,
+		share: 3,
+		new:   func() interface{} { return new(messageBufferMTU) },
+		slice: func(b interface{}) []byte { return b.(*messageBufferMTU)[:] },
+		array: func(b []byte) interface{} { return (*messageBufferMTU)(unsafe.Pointer(&b[0])) },
+	},
+	{
+		size:  MaxMessageSize,
+		share: 1,
+		new:   func() interface{} { return new(messageBufferMax) },
+		slice: func(b interface{}) []byte { return b.(*messageBufferMax)[:] },
+		array: func(b []byte) interface{} { return (*messageBufferMax)(unsafe.Pointer(&b[0])) },
+	},
+}
+
+type messageBufferPool struct {
+	messageBufferClass
+	pool      *sync.Pool
+	reuseChan chan []byte
+}
+
+/* Creates a pool for every distinct size class, classes must be given in ascending order of size.
+ * With preallocated buffers, these are split across the classes by their share,
+ * the share of a duplicate class goes to the class of its size.
+ */
+func newMessageBufferPools(classes []messageBufferClass, preallocated int) []messageBufferPool {
+	pools := make([]messageBufferPool, 0, len(classes))
+	total := 0
+	for _, class := range classes {
+		total += class.share
+		if len(pools) > 0 && class.size <= pools[len(pools)-1].size {
+			pools[len(pools)-1].share += class.share
+			continue
+		}
+		pools = append(pools, messageBufferPool{messageBufferClass: class})
+	}
+
+	for i := range pools {
+		pool := &pools[i]
+		if preallocated == 0 {
+			pool.pool = &sync.Pool{
+				New: pool.new,
+			}
+			continue
+		}
+		count := preallocated * pool.share / total
+		if count == 0 {
+			count = 1
+		}
+		pool.reuseChan = make(chan []byte, count)
+		for j := 0; j < count; j += 1 {
+			pool.reuseChan <- pool.slice(pool.new())
+		}
+	}
+	return pools
+}
 
 func (device *Device) PopulatePools() {
+	device.pool.messageBuffers = newMessageBufferPools(messageBufferClasses[:], PreallocatedBuffersPerPool)
 	if PreallocatedBuffersPerPool == 0 {
-		device.pool.messageBufferPool = &sync.Pool{
-			New: func() interface{} {
-				return new([MaxMessageSize]byte)
-			},
-		}
 		device.pool.inboundElementPool = &sync.Pool{
 			New: func() interface{} {
 				return new(QueueInboundElement)
@@ -25,10 +115,6 @@ func (device *Device) PopulatePools() {
 			},
 		}
 	} else {
-		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, PreallocatedBuffersPerPool)
-		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
-			device.pool.messageBufferReuseChan <- new([MaxMessageSize]byte)
-		}
 		device.pool.inboundElementReuseChan = make(chan *QueueInboundElement, PreallocatedBuffersPerPool)
 		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
 			device.pool.inboundElementReuseChan <- new(QueueInboundElement)
@@ -40,19 +126,69 @@ func (device *Device) PopulatePools() {
 	}
 }
 
-func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
-	if PreallocatedBuffersPerPool == 0 {
-		return device.pool.messageBufferPool.Get().(*[MaxMessageSize]byte)
-	} else {
-		return <-device.pool.messageBufferReuseChan
+/* Returns the size of the smallest buffer class holding at least size bytes
+ */
+func (device *Device) messageBufferSize(size int) int {
+	classes := device.pool.messageBuffers
+	for i := range classes {
+		if classes[i].size >= size {
+			return classes[i].size
+		}
 	}
+	return classes[len(classes)-1].size
 }
 
-func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
-	if PreallocatedBuffersPerPool == 0 {
-		device.pool.messageBufferPool.Put(msg)
-	} else {
-		device.pool.messageBufferReuseChan <- msg
+/* Returns a buffer from the smallest class holding at least size bytes,
+ * the length of the returned slice is the size of the class.
+ *
+ * Preallocated buffers of a larger class are used while the class is exhausted,
+ * waiting for a buffer of the class or of the largest class once all are.
+ */
+func (device *Device) GetMessageBuffer(size int) []byte {
+	classes := device.pool.messageBuffers
+	first := len(classes) - 1
+	for i := range classes {
+		if classes[i].size >= size {
+			first = i
+			break
+		}
+	}
+	class := &classes[first]
+	if class.reuseChan == nil {
+		return class.slice(class.pool.Get())
+	}
+
+	for i := first; i < len(classes); i++ {
+		select {
+		case buffer := <-classes[i].reuseChan:
+			return buffer
+		default:
+		}
+	}
+	select {
+	case buffer := <-class.reuseChan:
+		return buffer
+	case buffer := <-classes[len(classes)-1].reuseChan:
+		return buffer
+	}
+}
+
+/* Returns a buffer to the pool of its class,
+ * buffers which do not belong to any class are left to the garbage collector
+ */
+func (device *Device) PutMessageBuffer(msg []byte) {
+	msg = msg[:cap(msg)]
+	classes := device.pool.messageBuffers
+	for i := range classes {
+		if classes[i].size != len(msg) {
+			continue
+		}
+		if classes[i].reuseChan == nil {
+			classes[i].pool.Put(classes[i].array(msg))
+		} else {
+			classes[i].reuseChan <- msg
+		}
+		return
 	}
 }
 
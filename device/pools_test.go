@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestMessageBufferClasses(t *testing.T) {
+	var device Device
+	device.PopulatePools()
+
+	classes := device.pool.messageBuffers
+	for i := 1; i < len(classes); i++ {
+		if classes[i-1].size >= classes[i].size {
+			t.Fatal("buffer classes not strictly ascending:", classes[i-1].size, classes[i].size)
+		}
+	}
+	if classes[len(classes)-1].size != MaxMessageSize {
+		t.Fatal("largest buffer class does not hold a maximum sized message")
+	}
+
+	for _, size := range []int{0, 1, MessageKeepaliveSize, MessageInitiationSize, 1500, MaxMessageSize} {
+		buffer := device.GetMessageBuffer(size)
+		if len(buffer) < size {
+			t.Fatal("buffer too small for", size, "bytes:", len(buffer))
+		}
+		if len(buffer) != device.messageBufferSize(size) {
+			t.Fatal("buffer for", size, "bytes not of the smallest fitting class")
+		}
+		for _, class := range classes {
+			if class.size >= size && class.size < len(buffer) {
+				t.Fatal("buffer of", len(buffer), "bytes given for", size, "bytes, expected", class.size)
+			}
+		}
+		device.PutMessageBuffer(buffer[:size])
+	}
+
+	if len(device.GetMessageBuffer(MaxMessageSize+1)) != MaxMessageSize {
+		t.Fatal("oversized request not served from the largest class")
+	}
+}
+
+func TestPreallocatedBufferShares(t *testing.T) {
+	const preallocated = 4096
+
+	pools := newMessageBufferPools(messageBufferClasses[:], preallocated)
+	buffers, bytes := 0, 0
+	for _, pool := range pools {
+		buffers += cap(pool.reuseChan)
+		bytes += cap(pool.reuseChan) * pool.size
+	}
+	if buffers > preallocated {
+		t.Fatal("preallocated", buffers, "buffers, more than the budget of", preallocated)
+	}
+	if bytes >= preallocated*MaxMessageSize {
+		t.Fatal("split preallocation not smaller than a single class")
+	}
+
+	// exhausted classes are served from larger ones
+
+	var device Device
+	device.pool.messageBuffers = pools
+	small := cap(pools[0].reuseChan)
+	for i := 0; i < small; i++ {
+		device.GetMessageBuffer(MessageKeepaliveSize)
+	}
+	if buffer := device.GetMessageBuffer(MessageKeepaliveSize); len(buffer) != pools[1].size {
+		t.Fatal("exhausted class not served from the next larger one")
+	}
+}
+
+/* Returns the growth of the heap in use by f, after collecting garbage (and pooled buffers)
+ */
+func heapGrowth(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	if after.HeapInuse < before.HeapInuse {
+		return 0
+	}
+	return after.HeapInuse - before.HeapInuse
+}
+
+/* Fills a queue with small packets (as under load with TCP ACKs),
+ * reporting the heap in use per queued packet
+ */
+func benchmarkQueuedPackets(b *testing.B, classes []messageBufferClass, packetSize int) {
+	var device Device
+	device.pool.messageBuffers = newMessageBufferPools(classes, 0)
+
+	queue := make([][]byte, QueueOutboundSize)
+	fill := func() {
+		for i := range queue {
+			queue[i] = device.GetMessageBuffer(outboundBufferSize(packetSize))
+		}
+	}
+	drain := func() {
+		for i := range queue {
+			device.PutMessageBuffer(queue[i])
+			queue[i] = nil
+		}
+	}
+
+	resident := heapGrowth(fill)
+	drain()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		fill()
+		drain()
+	}
+
+	b.ReportMetric(float64(resident)/float64(len(queue)), "heap-B/packet")
+}
+
+func BenchmarkQueuedPacketsSingleClass(b *testing.B) {
+	benchmarkQueuedPackets(b, messageBufferClasses[len(messageBufferClasses)-1:], 60)
+}
+
+func BenchmarkQueuedPacketsSizeClasses(b *testing.B) {
+	benchmarkQueuedPackets(b, messageBufferClasses[:], 60)
+}
+
+func BenchmarkQueuedPacketsSizeClassesMTU(b *testing.B) {
+	benchmarkQueuedPackets(b, messageBufferClasses[:], DefaultMTU)
+}
+
+/* Reports the heap in use by the buffers preallocated on memory constrained platforms
+ */
+func benchmarkPreallocatedPools(b *testing.B, classes []messageBufferClass) {
+	var pools []messageBufferPool
+	var resident uint64
+	for n := 0; n < b.N; n++ {
+		pools = nil
+		resident = heapGrowth(func() {
+			pools = newMessageBufferPools(classes, 4096)
+		})
+	}
+	runtime.KeepAlive(pools)
+	b.ReportMetric(float64(resident)/(1<<20), "heap-MiB")
+}
+
+func BenchmarkPreallocatedPoolsSingleClass(b *testing.B) {
+	benchmarkPreallocatedPools(b, messageBufferClasses[len(messageBufferClasses)-1:])
+}
+
+func BenchmarkPreallocatedPoolsSizeClasses(b *testing.B) {
+	benchmarkPreallocatedPools(b, messageBufferClasses[:])
+}
@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/* Traffic analysis resistance of a peer.
+ *
+ * Padding transport messages to the MTU hides the sizes of packets, keepalives included.
+ * Chaff keepalives fill the slots of a fixed interval in which no data was sent,
+ * so that the traffic is independent of usage as long as the data fits the slots.
+ * Chaff is padded to the MTU too, indistinguishable from padded data.
+ * Padded keepalives are zeros, receivers recognize them by the IP version of zero and discard them.
+ */
+
+/* Pads all transport messages to the peer to the MTU of the tunnel
+ */
+func (peer *Peer) SetPadToMTU(enabled bool) {
+	peer.privacy.padToMTU.Set(enabled)
+}
+
+/* Sends chaff to the peer at every interval in which no data was sent, zero disables chaff
+ */
+func (peer *Peer) SetChaffInterval(interval time.Duration) error {
+	if interval < 0 {
+		return errors.New("invalid chaff interval")
+	}
+	if interval != 0 && interval < ChaffMinInterval {
+		return errors.New("chaff interval too short")
+	}
+
+	atomic.StoreInt64(&peer.privacy.chaffInterval, int64(interval))
+
+	peer.routines.Lock()
+	defer peer.routines.Unlock()
+
+	if !peer.isRunning.Get() {
+		return nil
+	}
+	if interval == 0 {
+		peer.timers.chaff.Del()
+	} else if peer.timersActive() {
+		peer.timers.chaff.Mod(interval)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrivacyPadding(t *testing.T) {
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53551
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=127.0.0.1:53552
+pad_to_mtu=true`
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53552
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32
+endpoint=127.0.0.1:53551`
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	peer1 := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer2 := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+
+	// the padding is stripped by the receiver, which sees messages of the MTU
+
+	msg := ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- msg
+	select {
+	case msgRecv := <-tun2.Inbound:
+		assertEqual(t, msgRecv, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	if padding := atomic.LoadUint64(&peer1.stats.txPadding); padding != uint64(DefaultMTU-(len(msg)+PaddingMultiple-1)/PaddingMultiple*PaddingMultiple) {
+		t.Fatal("unexpected padding", padding)
+	}
+	unit := uint64(DefaultMTU + MessageTransportSize)
+	rxBefore := atomic.LoadUint64(&peer2.stats.rxBytes)
+	if rxBefore != MessageInitiationSize+unit {
+		t.Fatal("unexpected size of padded message", rxBefore-MessageInitiationSize)
+	}
+
+	// without, content is padded to the padding multiple
+
+	msg = genICMPv4(make([]byte, 5), net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	if len(msg)%PaddingMultiple == 0 {
+		t.Fatal("test message already a multiple of the padding")
+	}
+	tun2.Outbound <- msg
+	select {
+	case msgRecv := <-tun1.Inbound:
+		assertEqual(t, msgRecv, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	padded := (len(msg) + PaddingMultiple - 1) / PaddingMultiple * PaddingMultiple
+	if rx := atomic.LoadUint64(&peer1.stats.rxBytes); rx != uint64(MessageResponseSize+padded+MessageTransportSize) {
+		t.Fatal("unexpected size of message", rx)
+	}
+
+	// chaff keepalives are sent at the interval, and are not delivered
+
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(
+		"public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nchaff_interval_ms=20\n"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tun2.Inbound:
+		t.Fatal("chaff delivered to the tunnel")
+	case <-time.After(300 * time.Millisecond):
+	}
+	assertNil(t, peer1.SetChaffInterval(0))
+
+	chaff := atomic.LoadUint64(&peer1.stats.txChaff)
+	if chaff < 5 {
+		t.Fatal("too few chaff keepalives", chaff)
+	}
+	if rx := atomic.LoadUint64(&peer2.stats.rxBytes) - rxBefore; rx == 0 || rx%unit != 0 {
+		t.Fatal("chaff not padded to the MTU", rx)
+	}
+
+	// data sent takes the place of chaff, the schedule stays
+
+	assertNil(t, peer1.SetChaffInterval(time.Hour))
+	chaff = atomic.LoadUint64(&peer1.stats.txChaff)
+	peer1.privacy.dataSent.Set(true)
+	expiredChaff(peer1)
+	if atomic.LoadUint64(&peer1.stats.txChaff) != chaff || !peer1.timers.chaff.IsPending() {
+		t.Fatal("chaff sent in slot of data")
+	}
+	expiredChaff(peer1)
+	if atomic.LoadUint64(&peer1.stats.txChaff) != chaff+1 {
+		t.Fatal("chaff not sent in slot without data")
+	}
+	assertNil(t, peer1.SetChaffInterval(0))
+
+	var config strings.Builder
+	writer := bufio.NewWriter(&config)
+	if err := dev1.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, line := range []string{"pad_to_mtu=true\n", "tx_padding_bytes=", "tx_chaff_packets="} {
+		if !strings.Contains(config.String(), line) {
+			t.Fatal("missing from configuration:", line)
+		}
+	}
+}
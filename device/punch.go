@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync/atomic"
+
+/* NAT hole punching towards a peer behind NAT, with candidate endpoints supplied out of band.
+ *
+ * Handshake initiations are sent to all candidates at once, in rounds spaced by PunchInterval,
+ * opening mappings in the NATs on both sides while the peer does the same.
+ * The first handshake to complete ends punching, roaming has then set the endpoint
+ * to the candidate the handshake message came from.
+ */
+
+/* Sets the candidate endpoints and starts punching, no candidates stop punching
+ */
+func (peer *Peer) SetPunchCandidates(endpoints []Endpoint) {
+	peer.Lock()
+	peer.punch.candidates = append([]Endpoint(nil), endpoints...)
+	peer.unsafeStartPunching()
+	peer.Unlock()
+}
+
+/* Adds a candidate endpoint and restarts punching
+ */
+func (peer *Peer) AddPunchCandidate(endpoint Endpoint) {
+	peer.Lock()
+	peer.punch.candidates = append(peer.punch.candidates, endpoint)
+	peer.unsafeStartPunching()
+	peer.Unlock()
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeStartPunching() {
+	if len(peer.punch.candidates) == 0 {
+		peer.punch.active.Set(false)
+		if peer.timersActive() {
+			peer.timers.punch.Del()
+		}
+		return
+	}
+
+	if peer.endpoint == nil {
+		peer.endpoint = peer.punch.candidates[0]
+	}
+	atomic.StoreInt32(&peer.punch.rounds, PunchAttempts)
+	peer.punch.active.Set(true)
+	if peer.timersActive() {
+		peer.timers.punch.Mod(0)
+	}
+}
+
+func expiredPunch(peer *Peer) {
+	if !peer.punch.active.Get() {
+		return
+	}
+	if atomic.AddInt32(&peer.punch.rounds, -1) < 0 {
+		if peer.punch.active.Swap(false) {
+			peer.device.log.Info.Println(peer, "- Hole punching failed, no handshake after", PunchAttempts, "rounds")
+		}
+		return
+	}
+
+	peer.RLock()
+	candidates := append([]Endpoint(nil), peer.punch.candidates...)
+	peer.RUnlock()
+
+	peer.device.log.Debug.Println(peer, "- Punching towards", len(candidates), "candidate endpoints")
+	peer.sendHandshakeInitiation(true, PunchInterval/2, candidates...)
+	if peer.timersActive() {
+		peer.timers.punch.Mod(PunchInterval)
+	}
+}
+
+/* Ends punching once a handshake completed
+ */
+func (peer *Peer) punchCompleted() {
+	if !peer.punch.active.Swap(false) {
+		return
+	}
+	if peer.timersActive() {
+		peer.timers.punch.Del()
+	}
+
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	if endpoint != nil {
+		peer.device.log.Info.Println(peer, "- Hole punched, using endpoint", endpoint.DstToString())
+	}
+}
@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHolePunching(t *testing.T) {
+
+	// candidates which never answer precede the reachable ones
+
+	blackhole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer blackhole.Close()
+
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53571
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+punch_candidate=` + blackhole.LocalAddr().String() + `
+punch_candidate=127.0.0.1:53572`
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53572
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32
+punch_candidate=` + blackhole.LocalAddr().String() + `
+punch_candidate=127.0.0.1:53571`
+
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// both sides lock onto the reachable candidate once a handshake completes
+
+	peer1 := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer2 := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	for _, p := range []struct {
+		peer     *Peer
+		endpoint string
+	}{{peer1, "127.0.0.1:53572"}, {peer2, "127.0.0.1:53571"}} {
+		deadline := time.Now().Add(5 * time.Second)
+		for p.peer.punch.active.Get() {
+			if time.Now().After(deadline) {
+				t.Fatal("hole punching did not complete")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		p.peer.RLock()
+		endpoint := p.peer.endpoint.DstToString()
+		p.peer.RUnlock()
+		assertEquals(t, endpoint, p.endpoint)
+	}
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping to", p.dst, "did not transit")
+		}
+	}
+
+	var config strings.Builder
+	writer := bufio.NewWriter(&config)
+	if err := dev1.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(config.String(), "punch_candidate=127.0.0.1:53572\n") || strings.Contains(config.String(), "punching=true") {
+		t.Fatal("unexpected punching state in configuration")
+	}
+}
@@ -13,4 +13,6 @@ const (
 	QueueHandshakeSize         = 1024
 	MaxSegmentSize             = (1 << 16) - 1 // largest possible UDP datagram
 	PreallocatedBuffersPerPool = 0             // Disable and allow for infinite memory growth
+	MessageBufferSizeSmall     = 256           // keepalives, handshakes and most TCP ACKs
+	MessageBufferSizeMTU       = 2048          // packets within a common tunnel MTU
 )
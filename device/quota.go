@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/* Per-peer data quotas, measured by the byte counters of the peer.
+ *
+ * Once the quota of a direction is exhausted, data packets of the peer
+ * are no longer forwarded in that direction, while handshakes and keepalives continue.
+ * Quotas are reset manually or at the start of every period (in UTC).
+ */
+
+type QuotaPeriod int
+
+const (
+	QuotaPeriodNone QuotaPeriod = iota
+	QuotaPeriodDaily
+	QuotaPeriodMonthly
+)
+
+func (period QuotaPeriod) String() string {
+	switch period {
+	case QuotaPeriodDaily:
+		return "daily"
+	case QuotaPeriodMonthly:
+		return "monthly"
+	default:
+		return "none"
+	}
+}
+
+func ParseQuotaPeriod(s string) (QuotaPeriod, error) {
+	switch s {
+	case "none":
+		return QuotaPeriodNone, nil
+	case "daily":
+		return QuotaPeriodDaily, nil
+	case "monthly":
+		return QuotaPeriodMonthly, nil
+	}
+	return QuotaPeriodNone, errors.New("invalid quota period")
+}
+
+/* Returns the start of the period following the one containing t
+ */
+func (period QuotaPeriod) next(t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case QuotaPeriodDaily:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	case QuotaPeriodMonthly:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}
+	}
+}
+
+type peerQuota struct {
+	limit     uint64 // bytes per period (0 = unlimited)
+	base      uint64 // counter of the peer at the start of the period
+	exhausted bool
+}
+
+func (quota *peerQuota) used(counter uint64) uint64 {
+	return counter - quota.base
+}
+
+func (quota *peerQuota) remaining(counter uint64) uint64 {
+	if used := quota.used(counter); used < quota.limit {
+		return quota.limit - used
+	}
+	return 0
+}
+
+/* Must hold peer.quota.Mutex
+ */
+func (peer *Peer) unsafeQuotaReset(now time.Time) {
+	peer.quota.tx.base = atomic.LoadUint64(&peer.stats.txBytes)
+	peer.quota.rx.base = atomic.LoadUint64(&peer.stats.rxBytes)
+	peer.quota.tx.exhausted = false
+	peer.quota.rx.exhausted = false
+	peer.quota.periodEnd = peer.quota.period.next(now)
+}
+
+/* Sets the quota of the peer in bytes per period (0 = unlimited),
+ * the usage of the current period is retained
+ */
+func (peer *Peer) SetQuota(direction PacketDirection, limit uint64) {
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+
+	if !peer.quota.enabled.Get() {
+		peer.unsafeQuotaReset(time.Now())
+	}
+	if direction == PacketInbound {
+		peer.quota.rx.limit = limit
+		peer.quota.rx.exhausted = false
+	} else {
+		peer.quota.tx.limit = limit
+		peer.quota.tx.exhausted = false
+	}
+	peer.quota.enabled.Set(peer.quota.tx.limit != 0 || peer.quota.rx.limit != 0)
+}
+
+/* Sets the period after which the quotas of the peer are reset,
+ * starting a new period
+ */
+func (peer *Peer) SetQuotaPeriod(period QuotaPeriod) {
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+	peer.quota.period = period
+	peer.quota.periodEnd = period.next(time.Now())
+}
+
+func (peer *Peer) ResetQuota() {
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+	peer.unsafeQuotaReset(time.Now())
+}
+
+/* Checks whether the quota of the peer permits forwarding data,
+ * starting a new period if due
+ */
+func (peer *Peer) quotaAllows(direction PacketDirection) bool {
+	now := time.Now()
+
+	peer.quota.Lock()
+	defer peer.quota.Unlock()
+
+	if !peer.quota.periodEnd.IsZero() && !now.Before(peer.quota.periodEnd) {
+		peer.device.log.Info.Println(peer, "- Starting new quota period")
+		peer.unsafeQuotaReset(now)
+	}
+
+	quota, counter, name := &peer.quota.tx, &peer.stats.txBytes, "Transmit"
+	if direction == PacketInbound {
+		quota, counter, name = &peer.quota.rx, &peer.stats.rxBytes, "Receive"
+	}
+
+	if quota.limit == 0 {
+		return true
+	}
+	if quota.used(atomic.LoadUint64(counter)) < quota.limit {
+		return true
+	}
+	if !quota.exhausted {
+		quota.exhausted = true
+		peer.device.log.Info.Println(peer, "-", name, "quota of", quota.limit, "bytes exhausted")
+	}
+	return false
+}
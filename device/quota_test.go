@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriod(t *testing.T) {
+	now := time.Date(2019, time.December, 31, 23, 59, 0, 0, time.UTC)
+	if next := QuotaPeriodDaily.next(now); !next.Equal(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start of next day:", next)
+	}
+	if next := QuotaPeriodMonthly.next(now); !next.Equal(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start of next month:", next)
+	}
+	if !QuotaPeriodNone.next(now).IsZero() {
+		t.Fatal("period without resets ends")
+	}
+
+	for _, period := range []QuotaPeriod{QuotaPeriodNone, QuotaPeriodDaily, QuotaPeriodMonthly} {
+		parsed, err := ParseQuotaPeriod(period.String())
+		if err != nil || parsed != period {
+			t.Fatal("failed to parse quota period", period)
+		}
+	}
+	if _, err := ParseQuotaPeriod("weekly"); err == nil {
+		t.Fatal("parsed invalid quota period")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	peer := &Peer{device: device}
+	peer.stats.txBytes = 5000 // usage before the quota is not charged
+
+	peer.SetQuota(PacketOutbound, 1000)
+	if !peer.quota.enabled.Get() {
+		t.Fatal("quota not enabled")
+	}
+	if !peer.quotaAllows(PacketOutbound) || !peer.quotaAllows(PacketInbound) {
+		t.Fatal("fresh quota not permitting data")
+	}
+
+	peer.stats.txBytes += 999
+	if !peer.quotaAllows(PacketOutbound) {
+		t.Fatal("quota exhausted early")
+	}
+	peer.stats.txBytes += 1
+	if peer.quotaAllows(PacketOutbound) {
+		t.Fatal("exhausted quota permitting data")
+	}
+	if !peer.quotaAllows(PacketInbound) {
+		t.Fatal("unlimited direction restricted")
+	}
+
+	// raising the quota retains the usage
+
+	peer.SetQuota(PacketOutbound, 2000)
+	if !peer.quotaAllows(PacketOutbound) || peer.quota.tx.remaining(peer.stats.txBytes) != 1000 {
+		t.Fatal("usage not retained when changing quota")
+	}
+
+	peer.stats.txBytes += 1000
+	if peer.quotaAllows(PacketOutbound) {
+		t.Fatal("exhausted quota permitting data")
+	}
+	peer.ResetQuota()
+	if !peer.quotaAllows(PacketOutbound) {
+		t.Fatal("quota not reset")
+	}
+
+	// new period
+
+	peer.SetQuotaPeriod(QuotaPeriodDaily)
+	peer.stats.txBytes += 2000
+	if peer.quotaAllows(PacketOutbound) {
+		t.Fatal("exhausted quota permitting data")
+	}
+	peer.quota.periodEnd = time.Now().Add(-time.Second)
+	if !peer.quotaAllows(PacketOutbound) {
+		t.Fatal("quota not reset at end of period")
+	}
+	if !peer.quota.periodEnd.After(time.Now()) {
+		t.Fatal("next period not scheduled")
+	}
+
+	peer.SetQuota(PacketOutbound, 0)
+	if peer.quota.enabled.Get() {
+		t.Fatal("quota enabled without limits")
+	}
+}
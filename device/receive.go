@@ -23,17 +23,19 @@ type QueueHandshakeElement struct {
 	msgType  uint32
 	packet   []byte
 	endpoint Endpoint
-	buffer   *[MaxMessageSize]byte
+	bind     Bind
+	buffer   []byte
 }
 
 type QueueInboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer   *[MaxMessageSize]byte
+	buffer   []byte
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
 	endpoint Endpoint
+	bind     Bind
 }
 
 func (elem *QueueInboundElement) Drop() {
@@ -101,9 +103,11 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - started")
 	device.net.starting.Done()
 
-	// receive datagrams until conn is closed
+	// receive datagrams until conn is closed,
+	// queued datagrams are copied into a buffer of the smallest fitting class,
+	// unless that is the class of the receive buffer, which is handed over instead
 
-	buffer := device.GetMessageBuffer()
+	buffer := device.GetMessageBuffer(MaxMessageSize)
 
 	var (
 		err      error
@@ -117,9 +121,9 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 
 		switch IP {
 		case ipv4.Version:
-			size, endpoint, err = bind.ReceiveIPv4(buffer[:])
+			size, endpoint, err = bind.ReceiveIPv4(buffer)
 		case ipv6.Version:
-			size, endpoint, err = bind.ReceiveIPv6(buffer[:])
+			size, endpoint, err = bind.ReceiveIPv6(buffer)
 		default:
 			panic("invalid IP version")
 		}
@@ -129,6 +133,13 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 			return
 		}
 
+		// demultiplex STUN responses, only while awaiting them:
+		// transport messages to receiver index 0x42a41221 look alike
+
+		if device.stun.awaiting.Get() && device.receiveSTUN(buffer[:size], endpoint) {
+			continue
+		}
+
 		if size < MinMessageSize {
 			continue
 		}
@@ -172,21 +183,26 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 			// create work element
 			peer := value.peer
 			elem := device.GetInboundElement()
-			elem.packet = packet
-			elem.buffer = buffer
+			if device.messageBufferSize(size) == len(buffer) {
+				elem.buffer = buffer
+				elem.packet = packet
+				buffer = device.GetMessageBuffer(MaxMessageSize)
+			} else {
+				elem.buffer = device.GetMessageBuffer(size)
+				elem.packet = elem.buffer[:copy(elem.buffer, packet)]
+			}
 			elem.keypair = keypair
 			elem.dropped = AtomicFalse
 			elem.endpoint = endpoint
+			elem.bind = bind
 			elem.counter = 0
 			elem.Mutex = sync.Mutex{}
 			elem.Lock()
 
 			// add to decryption queues
 
-			if peer.isRunning.Get() {
-				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
-					buffer = device.GetMessageBuffer()
-				}
+			if !peer.isRunning.Get() || !device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
+				device.PutMessageBuffer(elem.buffer)
 			}
 
 			continue
@@ -207,16 +223,15 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 		}
 
 		if okay {
-			if (device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-				},
-			)) {
-				buffer = device.GetMessageBuffer()
+			elem := QueueHandshakeElement{
+				msgType:  msgType,
+				buffer:   device.GetMessageBuffer(size),
+				endpoint: endpoint,
+				bind:     bind,
+			}
+			elem.packet = elem.buffer[:copy(elem.buffer, packet)]
+			if !device.addToHandshakeQueue(device.queue.handshake, elem) {
+				device.PutMessageBuffer(elem.buffer)
 			}
 		}
 	}
@@ -422,9 +437,11 @@ func (device *Device) RoutineHandshake() {
 
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
+			peer.keepaliveInitiationReceived()
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.setEndpointFromPacket(elem.endpoint, elem.bind)
+			peer.endpointCandidateReached(elem.endpoint, elem.bind)
 
 			logDebug.Println(peer, "- Received handshake initiation")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
@@ -455,7 +472,8 @@ func (device *Device) RoutineHandshake() {
 			}
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.setEndpointFromPacket(elem.endpoint, elem.bind)
+			peer.endpointCandidateReached(elem.endpoint, elem.bind)
 
 			logDebug.Println(peer, "- Received handshake response")
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
@@ -476,6 +494,7 @@ func (device *Device) RoutineHandshake() {
 
 			peer.timersSessionDerived()
 			peer.timersHandshakeComplete()
+			peer.keepaliveHandshakeComplete(elem.endpoint)
 			peer.SendKeepalive()
 			select {
 			case peer.signals.newKeypairArrived <- struct{}{}:
@@ -543,7 +562,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 
 		// update endpoint
-		peer.SetEndpointFromPacket(elem.endpoint)
+		peer.setEndpointFromPacket(elem.endpoint, elem.bind)
 
 		// check if using new keypair
 		if peer.ReceivedWithKeypair(elem.keypair) {
@@ -559,9 +578,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		peer.timersAnyAuthenticatedPacketReceived()
 		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
 
-		// check for keepalive
+		// check for keepalive, padded ones are zeros (of no IP version)
 
-		if len(elem.packet) == 0 {
+		if len(elem.packet) == 0 || elem.packet[0] == 0 {
 			logDebug.Println(peer, "- Receiving keepalive packet")
 			continue
 		}
@@ -630,6 +649,27 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			continue
 		}
 
+		if peer.quota.enabled.Get() && !peer.quotaAllows(PacketInbound) {
+			continue
+		}
+
+		if peer.conntrack.restricted.Get() && !peer.conntrackInbound(elem.packet) {
+			atomic.AddUint64(&peer.stats.rxRejected, 1)
+			continue
+		}
+
+		if filter := device.packetFilter(); filter != nil && !device.filterInbound(filter, peer, elem) {
+			continue
+		}
+
+		if peer.shaping.rx.limited.Get() && !peer.shapeInbound(elem) {
+			continue
+		}
+
+		if device.capture.enabled.Get() {
+			device.capturePacket(peer, elem.packet, captureInbound)
+		}
+
 		// write to tun device
 
 		offset := MessageTransportOffsetContent
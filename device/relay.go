@@ -0,0 +1,374 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/relay"
+)
+
+/* Exchange of messages with peers through a relay server, when direct connectivity fails.
+ *
+ * The main bind is wrapped to register the public key of the device with the relay,
+ * renewed every relay.RegisterInterval and proven by answering the challenge of the relay,
+ * and to frame messages to relay endpoints, which address peers by their public key.
+ * With relay fallback the relay endpoint is the last candidate endpoint of a peer (see failover.go),
+ * for as long as the relay bind is installed:
+ * the peer fails over to it once handshakes with the direct endpoints keep timing out,
+ * and returns to the preferred endpoint once it responds to probes again.
+ */
+
+type RelayEndpoint struct {
+	device *Device
+	key    NoisePublicKey // of the peer
+}
+
+var _ Endpoint = (*RelayEndpoint)(nil)
+
+func (end *RelayEndpoint) ClearSrc() {}
+
+func (end *RelayEndpoint) SrcToString() string {
+	return ""
+}
+
+/* Returns the address of the relay server
+ */
+func (end *RelayEndpoint) DstToString() string {
+	if server := end.device.relayServer(); server != nil {
+		return server.String()
+	}
+	return ""
+}
+
+func (end *RelayEndpoint) DstToBytes() []byte {
+	return end.key[:]
+}
+
+func (end *RelayEndpoint) DstIP() net.IP {
+	if server := end.device.relayServer(); server != nil {
+		return server.IP
+	}
+	return nil
+}
+
+func (end *RelayEndpoint) SrcIP() net.IP {
+	return nil
+}
+
+type relayBind struct {
+	Bind
+	device *Device
+	server Endpoint      // relay server, in the wrapped bind
+	sendMu sync.Mutex    // sends to the server endpoint are serialised, since they may clear its source
+	closed chan struct{} // stops renewing the registration
+}
+
+var _ MarkedBind = (*relayBind)(nil)
+var _ BufferedBind = (*relayBind)(nil)
+
+func (device *Device) relayServer() *net.UDPAddr {
+	server, _ := device.relay.server.Load().(*net.UDPAddr)
+	return server
+}
+
+/* Sets the relay server (host:port), an empty string disables relaying
+ */
+func (device *Device) SetRelayServer(server string) error {
+	var addr *net.UDPAddr
+	if server != "" {
+		var err error
+		addr, err = net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			return err
+		}
+	}
+	device.relay.server.Store(addr)
+	return device.BindUpdate()
+}
+
+/* Wraps the bind to exchange messages through the relay server, if set
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeRelayBind(bind Bind) Bind {
+	server := device.relayServer()
+	if server == nil {
+		return bind
+	}
+	if device.unsafeTransport() != UDPTransport {
+		device.log.Error.Println("Failed to use relay server: relaying requires the udp transport")
+		return bind
+	}
+	endpoint, err := device.unsafeTransport().CreateEndpoint(server.String())
+	if err != nil {
+		device.log.Error.Println("Failed to use relay server", server, ":", err)
+		return bind
+	}
+
+	relayed := &relayBind{
+		Bind:   bind,
+		device: device,
+		server: endpoint,
+		closed: make(chan struct{}),
+	}
+	go relayed.routineRegister()
+	return relayed
+}
+
+/* Requests registering the public key of the device with the relay server until the bind is closed,
+ * completed by the proof answering the challenge of the relay server
+ */
+func (bind *relayBind) routineRegister() {
+	var msg [relay.ChallengeSize]byte
+	msg[0] = relay.MessageRegister
+	for {
+		bind.device.staticIdentity.RLock()
+		copy(msg[1:], bind.device.staticIdentity.publicKey[:])
+		bind.device.staticIdentity.RUnlock()
+
+		bind.sendMu.Lock()
+		err := bind.Bind.Send(msg[:], bind.server)
+		bind.sendMu.Unlock()
+		if err != nil {
+			bind.device.log.Debug.Println("Failed to register with relay server:", err)
+		}
+
+		select {
+		case <-bind.closed:
+			return
+		case <-time.After(relay.RegisterInterval):
+		}
+	}
+}
+
+/* Answers the challenge of the relay server with the proof of owning the public key of the device
+ */
+func (bind *relayBind) prove(challenge []byte) {
+	var serverKey NoisePublicKey
+	copy(serverKey[:], challenge[1:relay.HeaderSize])
+
+	var msg [relay.ProofSize]byte
+	msg[0] = relay.MessageProof
+	copy(msg[relay.HeaderSize:], challenge[relay.HeaderSize:relay.ChallengeSize])
+
+	bind.device.staticIdentity.RLock()
+	if bind.device.staticIdentity.privateKey.IsZero() {
+		bind.device.staticIdentity.RUnlock()
+		return
+	}
+	copy(msg[1:], bind.device.staticIdentity.publicKey[:])
+	shared := bind.device.staticIdentity.privateKey.sharedSecret(serverKey)
+	bind.device.staticIdentity.RUnlock()
+
+	mac := relay.ProofMAC(&shared, msg[:])
+	setZero(shared[:])
+	copy(msg[relay.HeaderSize+relay.CookieSize:], mac[:])
+
+	bind.sendMu.Lock()
+	err := bind.Bind.Send(msg[:], bind.server)
+	bind.sendMu.Unlock()
+	if err != nil {
+		bind.device.log.Debug.Println("Failed to register with relay server:", err)
+	}
+}
+
+func (bind *relayBind) Close() error {
+	close(bind.closed)
+	return bind.Bind.Close()
+}
+
+func (bind *relayBind) receive(IP int, buff []byte) (int, Endpoint, error) {
+	for {
+		var size int
+		var end Endpoint
+		var err error
+		if IP == ipv4.Version {
+			size, end, err = bind.Bind.ReceiveIPv4(buff)
+		} else {
+			size, end, err = bind.Bind.ReceiveIPv6(buff)
+		}
+		if err != nil || !bytes.Equal(end.DstToBytes(), bind.server.DstToBytes()) {
+			return size, end, err
+		}
+
+		if size >= relay.ChallengeSize && buff[0] == relay.MessageChallenge {
+			bind.prove(buff[:size])
+			continue
+		}
+
+		// unframe messages relayed from peers
+
+		if size <= relay.HeaderSize || buff[0] != relay.MessageData {
+			continue
+		}
+		relayed := &RelayEndpoint{device: bind.device}
+		copy(relayed.key[:], buff[1:relay.HeaderSize])
+		copy(buff, buff[relay.HeaderSize:size])
+		return size - relay.HeaderSize, relayed, nil
+	}
+}
+
+func (bind *relayBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.receive(ipv4.Version, buff)
+}
+
+func (bind *relayBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.receive(ipv6.Version, buff)
+}
+
+/* Sends through the wrapped bind, with the mark if non-zero
+ */
+func (bind *relayBind) sendPacket(packet []byte, end Endpoint, mark uint32) error {
+	if mark != 0 {
+		if marked, ok := bind.Bind.(MarkedBind); ok {
+			return marked.SendWithMark(packet, end, mark)
+		}
+	}
+	return bind.Bind.Send(packet, end)
+}
+
+func (bind *relayBind) send(msg []byte, end Endpoint, mark uint32) error {
+	relayed, ok := end.(*RelayEndpoint)
+	if !ok {
+		return bind.sendPacket(msg, end, mark)
+	}
+
+	size := relay.HeaderSize + len(msg)
+	if size > MaxMessageSize {
+		return errors.New("message too large to relay")
+	}
+	buffer := bind.device.GetMessageBuffer(size)
+	defer bind.device.PutMessageBuffer(buffer)
+
+	packet := buffer[:size]
+	packet[0] = relay.MessageData
+	copy(packet[1:], relayed.key[:])
+	copy(packet[relay.HeaderSize:], msg)
+
+	bind.sendMu.Lock()
+	defer bind.sendMu.Unlock()
+	return bind.sendPacket(packet, bind.server, mark)
+}
+
+func (bind *relayBind) Send(buff []byte, end Endpoint) error {
+	return bind.send(buff, end, 0)
+}
+
+func (bind *relayBind) SendWithMark(buff []byte, end Endpoint, mark uint32) error {
+	return bind.send(buff, end, mark)
+}
+
+func (bind *relayBind) SetBufferSizes(receive, send int) error {
+	if buffered, ok := bind.Bind.(BufferedBind); ok {
+		return buffered.SetBufferSizes(receive, send)
+	}
+	return nil
+}
+
+func (bind *relayBind) Drops() uint64 {
+	if buffered, ok := bind.Bind.(BufferedBind); ok {
+		return buffered.Drops()
+	}
+	return 0
+}
+
+/* Returns the endpoint reaching the peer through the relay server
+ */
+func (peer *Peer) relayEndpoint() *RelayEndpoint {
+	return &RelayEndpoint{device: peer.device, key: peer.handshake.remoteStatic}
+}
+
+/* Enables falling back to the relay server, after the direct endpoints
+ */
+func (peer *Peer) SetRelayFallback(enabled bool) {
+	device := peer.device
+	device.net.RLock()
+	defer device.net.RUnlock()
+	peer.Lock()
+	defer peer.Unlock()
+
+	peer.endpoints.relayFallback = enabled
+	peer.unsafeUpdateRelayEndpoint(device.unsafeRelayInstalled())
+}
+
+/* Reports whether the bind of the device exchanges messages through the relay server
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeRelayInstalled() bool {
+	bind := device.net.bind
+	if obfuscated, ok := bind.(*obfuscatedBind); ok {
+		bind = obfuscated.Bind
+	}
+	_, ok := bind.(*relayBind)
+	return ok
+}
+
+/* Offers the relay endpoint to the peers with relay fallback, or withdraws it, as the relay bind is installed or not
+ *
+ * Must hold device.net.RWMutex
+ */
+func (device *Device) unsafeUpdateRelayEndpoints() {
+	installed := device.unsafeRelayInstalled()
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		peer.unsafeUpdateRelayEndpoint(installed)
+		peer.Unlock()
+	}
+	device.peers.RUnlock()
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeUpdateRelayEndpoint(installed bool) {
+	offer := installed && peer.endpoints.relayFallback
+	if offer && !peer.endpoints.relay {
+		peer.unsafeAddFallbackEndpoint(peer.relayEndpoint())
+		peer.endpoints.relay = true
+	} else if !offer && peer.endpoints.relay {
+		peer.unsafeRemoveRelayEndpoint()
+	}
+
+	// the peer may have roamed to the relay, reply directly once it is gone
+
+	if _, ok := peer.endpoint.(*RelayEndpoint); ok && !installed {
+		peer.endpoint = nil
+		peer.endpointBind = nil
+		if len(peer.endpoints.candidates) > 0 {
+			peer.endpoint = peer.endpoints.candidates[peer.endpoints.active]
+		}
+	}
+}
+
+/* Removes the relay endpoint, the last candidate
+ *
+ * Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeRemoveRelayEndpoint() {
+	peer.endpoints.relay = false
+	last := len(peer.endpoints.candidates) - 1
+	peer.endpoints.candidates = peer.endpoints.candidates[:last]
+	if peer.endpoints.active != last {
+		return
+	}
+	peer.endpoints.active = 0
+	peer.endpoint = nil
+	peer.endpointBind = nil
+	if last > 0 {
+		peer.endpoint = peer.endpoints.candidates[0]
+	}
+	if peer.timersActive() {
+		peer.timers.probeEndpoint.Del()
+	}
+}
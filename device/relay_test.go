@@ -0,0 +1,219 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/relay"
+)
+
+func TestRelayFallback(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assertNil(t, err)
+	defer conn.Close()
+	go relay.NewServer(conn).Serve()
+
+	// the direct endpoint of dev2 never answers, dev1 is not reachable directly at all
+
+	blackhole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	defer blackhole.Close()
+
+	cfg1 := `private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58
+listen_port=53581
+relay_server=` + conn.LocalAddr().String() + `
+replace_peers=true
+public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.2/32
+endpoint=` + blackhole.LocalAddr().String() + `
+relay_fallback=true`
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=53582
+relay_server=` + conn.LocalAddr().String() + `
+replace_peers=true
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=1.0.0.1/32
+relay_fallback=true`
+
+	tun1 := NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	tun2 := NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // registrations with the relay
+
+	// fail over as after handshakes to the direct endpoint timed out
+
+	peer1 := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer2 := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	peer1.failoverEndpoint()
+
+	for _, p := range []struct {
+		src, dst net.IP
+		in       chan []byte
+		out      chan []byte
+	}{
+		{net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), tun1.Outbound, tun2.Inbound},
+		{net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), tun2.Outbound, tun1.Inbound},
+	} {
+		msg := ping(p.dst, p.src)
+		p.in <- msg
+		select {
+		case msgRecv := <-p.out:
+			assertEqual(t, msgRecv, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping to", p.dst, "did not transit the relay")
+		}
+	}
+
+	for _, peer := range []*Peer{peer1, peer2} {
+		peer.RLock()
+		_, relayed := peer.endpoint.(*RelayEndpoint)
+		peer.RUnlock()
+		if !relayed {
+			t.Fatal("peer not using the relay")
+		}
+	}
+
+	var config strings.Builder
+	writer := bufio.NewWriter(&config)
+	if err := dev1.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, line := range []string{
+		"relay_server=" + conn.LocalAddr().String() + "\n",
+		"preferred_endpoint=" + blackhole.LocalAddr().String() + "\n",
+		"relay_fallback=true\n",
+		"relayed=true\n",
+	} {
+		if !strings.Contains(config.String(), line) {
+			t.Fatal("missing from configuration:", line)
+		}
+	}
+	if strings.Contains(config.String(), "fallback_endpoint=") {
+		t.Fatal("relay endpoint listed as fallback endpoint")
+	}
+
+	// clearing the relay server withdraws the relay endpoint
+
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader("relay_server=\n"))); err != nil {
+		t.Fatal(err)
+	}
+	peer1.RLock()
+	_, relayed := peer1.endpoint.(*RelayEndpoint)
+	candidates := len(peer1.endpoints.candidates)
+	peer1.RUnlock()
+	if relayed || candidates != 1 {
+		t.Fatal("relay endpoint kept without relay server")
+	}
+	assertNil(t, peer1.SendBuffer([]byte{0}))
+}
+
+func TestRelayFallbackCandidates(t *testing.T) {
+	peer := &Peer{device: &Device{log: NewLogger(LogLevelError, "")}}
+	peer.device.net.bind = &relayBind{}
+	endpoint := func(s string) Endpoint {
+		endpoint, err := CreateEndpoint(s)
+		assertNil(t, err)
+		return endpoint
+	}
+
+	// without endpoints the relay is used right away
+
+	peer.SetRelayFallback(true)
+	if _, ok := peer.endpoint.(*RelayEndpoint); !ok {
+		t.Fatal("relay not used without endpoint")
+	}
+
+	// the relay remains the last candidate
+
+	peer.Lock()
+	peer.unsafeSetPreferredEndpoint(endpoint("192.0.2.1:51820"))
+	peer.unsafeAddFallbackEndpoint(endpoint("198.51.100.1:51820"))
+	candidates := append([]Endpoint(nil), peer.endpoints.candidates...)
+	peer.Unlock()
+	if len(candidates) != 3 || candidates[1].DstToString() != "198.51.100.1:51820" {
+		t.Fatal("unexpected candidates", candidates)
+	}
+	if _, ok := candidates[2].(*RelayEndpoint); !ok {
+		t.Fatal("relay not the last candidate")
+	}
+
+	peer.failoverEndpoint()
+	peer.failoverEndpoint()
+	if _, ok := peer.endpoint.(*RelayEndpoint); !ok {
+		t.Fatal("did not fail over to the relay")
+	}
+
+	// disabling the fallback returns to the preferred endpoint
+
+	peer.SetRelayFallback(false)
+	if len(peer.endpoints.candidates) != 2 || peer.endpoint.DstToString() != "192.0.2.1:51820" {
+		t.Fatal("relay not removed")
+	}
+
+	// the relay is only offered while the device relays
+
+	peer.SetRelayFallback(true)
+	peer.failoverEndpoint()
+	peer.failoverEndpoint()
+	peer.device.net.bind = nil
+	peer.Lock()
+	peer.unsafeUpdateRelayEndpoint(peer.device.unsafeRelayInstalled())
+	peer.Unlock()
+	if len(peer.endpoints.candidates) != 2 || peer.endpoint.DstToString() != "192.0.2.1:51820" {
+		t.Fatal("relay not withdrawn with the relay bind")
+	}
+	peer.SetRelayFallback(true)
+	if len(peer.endpoints.candidates) != 2 || !peer.endpoints.relayFallback {
+		t.Fatal("relay offered without relay bind")
+	}
+
+	// removing the fallbacks keeps the relay
+
+	peer.device.net.bind = &relayBind{}
+	peer.Lock()
+	peer.unsafeUpdateRelayEndpoint(peer.device.unsafeRelayInstalled())
+	peer.Unlock()
+	peer.failoverEndpoint()
+	peer.failoverEndpoint()
+	peer.Lock()
+	peer.unsafeRemoveFallbackEndpoints()
+	candidates = append([]Endpoint(nil), peer.endpoints.candidates...)
+	peer.Unlock()
+	if _, ok := peer.endpoint.(*RelayEndpoint); !ok || len(candidates) != 2 || candidates[1] != peer.endpoint {
+		t.Fatal("relay not kept with fallbacks removed", candidates)
+	}
+}
+
+func TestNativeBindForeignEndpoint(t *testing.T) {
+	bind, _, err := CreateBind(0, nil)
+	assertNil(t, err)
+	defer bind.Close()
+	if err := bind.Send([]byte{0}, &RelayEndpoint{}); err == nil {
+		t.Fatal("sent to endpoint of another transport")
+	}
+}
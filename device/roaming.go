@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+)
+
+/* Per-peer roaming control.
+ *
+ * Roaming may be disabled for a peer, pinning its endpoint,
+ * or restricted to source addresses within a set of prefixes.
+ * A peer without endpoint may still learn its first endpoint from an allowed address.
+ */
+
+/* Disables roaming of the peer, pinning its current endpoint
+ */
+func (peer *Peer) SetRoamingDisabled(disabled bool) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.roaming.disabled = disabled
+	peer.unsafeUpdateRoamingRestricted()
+}
+
+/* Restricts roaming of the peer to the prefixes, nil removes the restriction
+ */
+func (peer *Peer) SetRoamingAllowedIPs(prefixes []net.IPNet) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.roaming.allowedIPs = append([]net.IPNet(nil), prefixes...)
+	peer.unsafeUpdateRoamingRestricted()
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeAddRoamingAllowedIP(prefix net.IPNet) {
+	peer.roaming.allowedIPs = append(peer.roaming.allowedIPs, prefix)
+	peer.unsafeUpdateRoamingRestricted()
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeUpdateRoamingRestricted() {
+	peer.roaming.restricted.Set(peer.roaming.disabled || len(peer.roaming.allowedIPs) > 0)
+	peer.roaming.lastRejected = nil
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeRoamingAllowed(ip net.IP) bool {
+	if len(peer.roaming.allowedIPs) == 0 {
+		return true
+	}
+	for _, prefix := range peer.roaming.allowedIPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Updates the endpoint of a peer with restricted roaming,
+ * counting and logging rejected changes of the address
+ */
+func (peer *Peer) setEndpointRestricted(endpoint Endpoint, bind Bind) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	dst := endpoint.DstToBytes()
+
+	if peer.endpoint != nil && bytes.Equal(peer.endpoint.DstToBytes(), dst) {
+		peer.endpoint = endpoint
+		peer.endpointBind = bind
+		return
+	}
+
+	if (peer.endpoint == nil || !peer.roaming.disabled) && peer.unsafeRoamingAllowed(endpoint.DstIP()) {
+		peer.device.log.Info.Println(peer, "- Roaming to", endpoint.DstToString())
+		peer.endpoint = endpoint
+		peer.endpointBind = bind
+		peer.roaming.lastRejected = nil
+		return
+	}
+
+	atomic.AddUint64(&peer.stats.roamingRejected, 1)
+
+	// log once per rejected address
+
+	if !bytes.Equal(peer.roaming.lastRejected, dst) {
+		peer.roaming.lastRejected = append(peer.roaming.lastRejected[:0], dst...)
+		peer.device.log.Info.Println(peer, "- Rejected roaming to", endpoint.DstToString())
+	}
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRoamingControl(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	peer := &Peer{device: device}
+
+	endpoint := func(s string) Endpoint {
+		endpoint, err := CreateEndpoint(s)
+		assertNil(t, err)
+		return endpoint
+	}
+	roam := func(s string) string {
+		peer.SetEndpointFromPacket(endpoint(s))
+		return peer.endpoint.DstToString()
+	}
+
+	// unrestricted peers roam freely
+
+	if roam("192.0.2.1:1000") != "192.0.2.1:1000" || roam("198.51.100.1:1000") != "198.51.100.1:1000" {
+		t.Fatal("unrestricted peer did not roam")
+	}
+
+	// pinned endpoint
+
+	peer.SetRoamingDisabled(true)
+	if roam("192.0.2.1:1000") != "198.51.100.1:1000" || roam("192.0.2.1:1000") != "198.51.100.1:1000" {
+		t.Fatal("peer roamed with roaming disabled")
+	}
+	if roam("198.51.100.1:1000") != "198.51.100.1:1000" {
+		t.Fatal("packets from pinned endpoint not accepted")
+	}
+	if peer.stats.roamingRejected != 2 {
+		t.Fatal("rejected roaming not counted:", peer.stats.roamingRejected)
+	}
+	peer.SetRoamingDisabled(false)
+
+	// roaming within prefixes
+
+	_, management, _ := net.ParseCIDR("10.0.0.0/8")
+	_, management6, _ := net.ParseCIDR("fd00::/8")
+	peer.SetRoamingAllowedIPs([]net.IPNet{*management, *management6})
+
+	if roam("192.0.2.1:1000") != "198.51.100.1:1000" {
+		t.Fatal("peer roamed outside of allowed prefixes")
+	}
+	if roam("10.1.2.3:1000") != "10.1.2.3:1000" || roam("[fd00::1]:1000") != "[fd00::1]:1000" {
+		t.Fatal("peer did not roam within allowed prefixes")
+	}
+	if peer.stats.roamingRejected != 3 {
+		t.Fatal("rejected roaming not counted:", peer.stats.roamingRejected)
+	}
+
+	// the first endpoint is learned, even with roaming disabled
+
+	peer = &Peer{device: device}
+	peer.SetRoamingDisabled(true)
+	if roam("192.0.2.1:1000") != "192.0.2.1:1000" {
+		t.Fatal("endpoint not learned")
+	}
+	if roam("192.0.2.2:1000") != "192.0.2.1:1000" {
+		t.Fatal("peer roamed with roaming disabled")
+	}
+
+	peer.SetRoamingDisabled(false)
+	if peer.roaming.restricted.Get() {
+		t.Fatal("roaming restricted without restrictions")
+	}
+}
@@ -0,0 +1,231 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* Fair queuing of the peers in the shared encryption queue (deficit round robin).
+ *
+ * The nonce routine of every peer stages its elements in a queue of the peer,
+ * from which the scheduler moves them to the encryption queue,
+ * granting every peer with staged elements SchedulerQuantum bytes per round.
+ * A busy peer thereby fills (and drops from) its own staged queue
+ * rather than the encryption queue shared by all peers.
+ *
+ * Elements leave the staged queue of a peer in order,
+ * hence the sequential queue of the peer is unaffected.
+ */
+
+func (elem *QueueOutboundElement) scheduleCost() int {
+	return MessageTransportSize + len(elem.packet)
+}
+
+/* Inserts an element into the sequential and staged queues of the peer,
+ * the element must be locked
+ */
+func addToOutboundAndStagedQueues(peer *Peer, element *QueueOutboundElement) {
+	device := peer.device
+	select {
+	case peer.queue.outbound <- element:
+		select {
+		case peer.queue.staged <- element:
+			device.scheduleActivate(peer)
+		default:
+			element.Drop()
+			device.PutMessageBuffer(element.buffer)
+			element.Unlock()
+		}
+	default:
+		device.PutMessageBuffer(element.buffer)
+		device.PutOutboundElement(element)
+	}
+}
+
+/* Appends the peer to the round, unless it is already part of it
+ */
+func (device *Device) scheduleActivate(peer *Peer) {
+	if peer.scheduler.active.Swap(true) {
+		return
+	}
+	device.scheduleAppend(peer)
+	select {
+	case device.scheduler.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (device *Device) scheduleAppend(peer *Peer) {
+	device.scheduler.Lock()
+	defer device.scheduler.Unlock()
+	peer.scheduler.next = nil
+	if device.scheduler.tail == nil {
+		device.scheduler.head = peer
+	} else {
+		device.scheduler.tail.scheduler.next = peer
+	}
+	device.scheduler.tail = peer
+}
+
+/* Moves elements from the staged queues of the peers
+ * to the encryption queue, in deficit round robin order
+ *
+ * Obs. Single instance
+ */
+func (device *Device) RoutineScheduler() {
+	logDebug := device.log.Debug
+
+	defer func() {
+
+		// as the last sender, drop elements the encryption workers missed
+
+		for {
+			select {
+			case elem := <-device.queue.encryption:
+				if !elem.IsDropped() {
+					elem.Drop()
+					device.PutMessageBuffer(elem.buffer)
+					elem.Unlock()
+				}
+			default:
+				goto out
+			}
+		}
+	out:
+		logDebug.Println("Routine: scheduler - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: scheduler - started")
+	device.state.starting.Done()
+
+	for {
+
+		// take the next peer of the round
+
+		device.scheduler.Lock()
+		peer := device.scheduler.head
+		if peer == nil {
+			device.scheduler.Unlock()
+			select {
+			case <-device.signals.stop:
+				return
+			case <-device.scheduler.signal:
+				continue
+			}
+		}
+		device.scheduler.head = peer.scheduler.next
+		if device.scheduler.head == nil {
+			device.scheduler.tail = nil
+		}
+		device.scheduler.Unlock()
+
+		// release elements within the deficit of the peer
+
+		if !device.scheduleRelease(peer) {
+			return
+		}
+	}
+}
+
+/* Releases the staged elements of the peer within its deficit to the encryption queue,
+ * returns false if the device stopped meanwhile
+ */
+func (device *Device) scheduleRelease(peer *Peer) bool {
+	peer.scheduler.Lock()
+	defer peer.scheduler.Unlock()
+
+	empty := false
+	peer.scheduler.deficit += SchedulerQuantum
+	for {
+		elem := peer.scheduler.head
+		if elem == nil {
+			select {
+			case elem = <-peer.queue.staged:
+			default:
+			}
+		}
+		if elem == nil {
+			empty = true
+			break
+		}
+		if cost := elem.scheduleCost(); cost > peer.scheduler.deficit {
+			peer.scheduler.head = elem
+			break
+		} else {
+			peer.scheduler.deficit -= cost
+			peer.scheduler.head = nil
+		}
+		select {
+		case device.queue.encryption <- elem:
+		case <-device.signals.stop:
+
+			// keep the element, for the flush of the round
+
+			peer.scheduler.head = elem
+			device.scheduleAppend(peer)
+			return false
+		}
+	}
+
+	if !empty {
+		device.scheduleAppend(peer)
+		return true
+	}
+
+	// idle peers do not accumulate a deficit,
+	// recheck for elements staged before the peer was marked inactive
+
+	peer.scheduler.deficit = 0
+	peer.scheduler.active.Set(false)
+	if len(peer.queue.staged) > 0 {
+		device.scheduleActivate(peer)
+	}
+	return true
+}
+
+/* Drops the staged elements of the peer, releasing their buffers and mutexes,
+ * the elements themselves are returned by the sequential sender
+ */
+func (peer *Peer) FlushStagedQueue() {
+	device := peer.device
+	peer.scheduler.Lock()
+	defer peer.scheduler.Unlock()
+
+	drop := func(elem *QueueOutboundElement) {
+		elem.Drop()
+		device.PutMessageBuffer(elem.buffer)
+		elem.Unlock()
+	}
+	if peer.scheduler.head != nil {
+		drop(peer.scheduler.head)
+		peer.scheduler.head = nil
+	}
+	for {
+		select {
+		case elem := <-peer.queue.staged:
+			drop(elem)
+		default:
+			peer.scheduler.deficit = 0
+			return
+		}
+	}
+}
+
+/* Flushes the staged queues of the peers left in the round,
+ * once the scheduler stopped
+ */
+func (device *Device) flushScheduledPeers() {
+	device.scheduler.Lock()
+	peer := device.scheduler.head
+	device.scheduler.head = nil
+	device.scheduler.tail = nil
+	device.scheduler.Unlock()
+
+	for peer != nil {
+		next := peer.scheduler.next
+		peer.FlushStagedQueue()
+		peer.scheduler.active.Set(false)
+		peer = next
+	}
+}
@@ -0,0 +1,224 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func newSchedulerTestDevice() *Device {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	device.PopulatePools()
+	device.queue.encryption = make(chan *QueueOutboundElement) // a single busy encryption worker
+	device.signals.stop = make(chan struct{})
+	device.scheduler.signal = make(chan struct{}, 1)
+	device.state.starting.Add(1)
+	device.state.stopping.Add(1)
+	go device.RoutineScheduler()
+	device.state.starting.Wait()
+	return device
+}
+
+func newSchedulerTestPeer(device *Device) *Peer {
+	peer := &Peer{device: device}
+	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
+	peer.queue.staged = make(chan *QueueOutboundElement, QueueOutboundSize)
+	return peer
+}
+
+func newSchedulerTestElement(peer *Peer, nonce uint64) *QueueOutboundElement {
+	elem := peer.device.NewOutboundElement(DefaultMTU)
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+DefaultMTU]
+	elem.peer = peer
+	elem.nonce = nonce
+	return elem
+}
+
+/* Receives the next element from the encryption queue and releases it
+ */
+func encryptTestElement(device *Device) (peer *Peer, nonce uint64) {
+	elem := <-device.queue.encryption
+	peer, nonce = elem.peer, elem.nonce
+	device.PutMessageBuffer(elem.buffer)
+	elem.Unlock()
+	return
+}
+
+func drainSchedulerTestPeer(peer *Peer) {
+	for len(peer.queue.outbound) > 0 {
+		peer.device.PutOutboundElement(<-peer.queue.outbound)
+	}
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	device := newSchedulerTestDevice()
+	defer func() {
+		close(device.signals.stop)
+		device.state.stopping.Wait()
+	}()
+
+	const bulkPackets = 100
+	bulk, interactive := newSchedulerTestPeer(device), newSchedulerTestPeer(device)
+
+	for i := 0; i < bulkPackets; i++ {
+		elem := newSchedulerTestElement(bulk, uint64(i))
+		elem.Lock()
+		addToOutboundAndStagedQueues(bulk, elem)
+	}
+	for i := 0; i < 2; i++ {
+		elem := newSchedulerTestElement(interactive, uint64(i))
+		elem.Lock()
+		addToOutboundAndStagedQueues(interactive, elem)
+	}
+
+	next := map[*Peer]uint64{}
+	position := map[*Peer]int{}
+	for i := 0; i < bulkPackets+2; i++ {
+		peer, nonce := encryptTestElement(device)
+		if nonce != next[peer] {
+			t.Fatal("elements of peer reordered: expected", next[peer], "got", nonce)
+		}
+		next[peer]++
+		position[peer] = i
+	}
+
+	perRound := SchedulerQuantum/(MessageTransportSize+DefaultMTU) + 1
+	if position[interactive] > 3*perRound {
+		t.Fatal("interactive peer starved behind", position[interactive], "bulk packets")
+	}
+
+	// the sequential queues are untouched
+
+	for _, peer := range []*Peer{bulk, interactive} {
+		for nonce := uint64(0); len(peer.queue.outbound) > 0; nonce++ {
+			elem := <-peer.queue.outbound
+			if elem.nonce != nonce {
+				t.Fatal("sequential queue reordered")
+			}
+			device.PutOutboundElement(elem)
+		}
+	}
+
+	// the scheduler notices idle peers after releasing their last element
+
+	for i := 0; bulk.scheduler.active.Get() || interactive.scheduler.active.Get(); i++ {
+		if i == 100 {
+			t.Fatal("idle peers still part of the round")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	device := newSchedulerTestDevice()
+	peer := newSchedulerTestPeer(device)
+
+	// the scheduler blocks on the encryption queue, holding an element
+
+	const packets = 10
+	for i := 0; i < packets; i++ {
+		elem := newSchedulerTestElement(peer, uint64(i))
+		elem.Lock()
+		addToOutboundAndStagedQueues(peer, elem)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	close(device.signals.stop)
+	device.state.stopping.Wait()
+	device.FlushPacketQueues()
+
+	// every element is released to the sequential sender, as dropped
+
+	done := make(chan struct{})
+	go func() {
+		for len(peer.queue.outbound) > 0 {
+			elem := <-peer.queue.outbound
+			elem.Lock()
+			if !elem.IsDropped() {
+				t.Error("element not dropped")
+			}
+			device.PutOutboundElement(elem)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("element still locked after stop")
+	}
+	if peer.scheduler.head != nil || peer.scheduler.active.Get() || len(peer.queue.staged) > 0 {
+		t.Fatal("scheduler state of peer not reset")
+	}
+}
+
+/* Stages a bulk transfer of one peer followed by a packet of another,
+ * reporting the number of packets encrypted ahead of the latter
+ */
+func benchmarkInteractiveLatency(b *testing.B, fair bool) {
+	const bulkPackets = 512
+
+	device := newSchedulerTestDevice()
+	defer func() {
+		close(device.signals.stop)
+		device.state.stopping.Wait()
+	}()
+	bulk, interactive := newSchedulerTestPeer(device), newSchedulerTestPeer(device)
+
+	// without the scheduler, elements enter the shared queue first in, first out
+
+	fifo := make(chan *QueueOutboundElement, bulkPackets+1)
+	stage := func(peer *Peer, nonce uint64) {
+		elem := newSchedulerTestElement(peer, nonce)
+		elem.Lock()
+		if fair {
+			addToOutboundAndStagedQueues(peer, elem)
+		} else {
+			fifo <- elem
+		}
+	}
+	dequeue := func() *Peer {
+		if !fair {
+			elem := <-fifo
+			peer := elem.peer
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			return peer
+		}
+		peer, _ := encryptTestElement(device)
+		return peer
+	}
+
+	ahead := 0
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < bulkPackets; i++ {
+			stage(bulk, uint64(i))
+		}
+		stage(interactive, 0)
+
+		for i := 0; i <= bulkPackets; i++ {
+			if dequeue() == interactive {
+				ahead += i
+			}
+		}
+		drainSchedulerTestPeer(bulk)
+		drainSchedulerTestPeer(interactive)
+	}
+
+	b.ReportMetric(float64(ahead)/float64(b.N), "packets-ahead")
+}
+
+func BenchmarkInteractiveLatencyFIFO(b *testing.B) {
+	benchmarkInteractiveLatency(b, false)
+}
+
+func BenchmarkInteractiveLatencyScheduler(b *testing.B) {
+	benchmarkInteractiveLatency(b, true)
+}
@@ -45,21 +45,34 @@ import (
 type QueueOutboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer    []byte    // pooled buffer holding the packet data
+	packet    []byte    // slice of "buffer" (always!)
+	nonce     uint64    // nonce for encryption
+	keypair   *Keypair  // keypair for encryption
+	peer      *Peer     // related peer
+	sendAfter time.Time // delay imposed by the rate limit of the peer (zero = none)
+	keepalive bool      // carries no packet, set on encryption (padding may follow)
+	chaff     bool      // keepalive sent as cover traffic, padded to the MTU
 }
 
-func (device *Device) NewOutboundElement() *QueueOutboundElement {
+/* Returns the buffer size needed to construct a transport message
+ * with the given amount of content in-place
+ */
+func outboundBufferSize(contentSize int) int {
+	return MessageTransportSize + contentSize + PaddingMultiple - 1
+}
+
+func (device *Device) NewOutboundElement(contentSize int) *QueueOutboundElement {
 	elem := device.GetOutboundElement()
 	elem.dropped = AtomicFalse
-	elem.buffer = device.GetMessageBuffer()
+	elem.buffer = device.GetMessageBuffer(outboundBufferSize(contentSize))
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
 	elem.keypair = nil
 	elem.peer = nil
+	elem.keepalive = false
+	elem.chaff = false
+	elem.sendAfter = time.Time{}
 	return elem
 }
 
@@ -87,34 +100,31 @@ func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundEle
 	}
 }
 
-func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement, encryptionQueue chan *QueueOutboundElement, element *QueueOutboundElement) {
-	select {
-	case outboundQueue <- element:
-		select {
-		case encryptionQueue <- element:
-			return
-		default:
-			element.Drop()
-			element.peer.device.PutMessageBuffer(element.buffer)
-			element.Unlock()
-		}
-	default:
-		element.peer.device.PutMessageBuffer(element.buffer)
-		element.peer.device.PutOutboundElement(element)
+/* Queues a keepalive if no packets are queued for peer
+ */
+func (peer *Peer) SendKeepalive() bool {
+	if len(peer.queue.nonce) != 0 {
+		return false
 	}
+	return peer.queueKeepalive(false)
 }
 
-/* Queues a keepalive if no packets are queued for peer
+/* Queues a keepalive, as chaff padded to the MTU, unless awaiting a session
  */
-func (peer *Peer) SendKeepalive() bool {
-	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
+func (peer *Peer) queueKeepalive(chaff bool) bool {
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
 		return false
 	}
-	elem := peer.device.NewOutboundElement()
+	elem := peer.device.NewOutboundElement(0)
 	elem.packet = nil
+	elem.chaff = chaff
 	select {
 	case peer.queue.nonce <- elem:
-		peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
+		if chaff {
+			peer.device.log.Debug.Println(peer, "- Sending chaff packet")
+		} else {
+			peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
+		}
 		return true
 	default:
 		peer.device.PutMessageBuffer(elem.buffer)
@@ -124,19 +134,26 @@ func (peer *Peer) SendKeepalive() bool {
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+	return peer.sendHandshakeInitiation(isRetry, RekeyTimeout)
+}
+
+/* Sends a handshake initiation to the endpoints, or the current endpoint of the peer if none,
+ * unless a handshake message was sent within the interval
+ */
+func (peer *Peer) sendHandshakeInitiation(isRetry bool, interval time.Duration, endpoints ...Endpoint) error {
 	if !isRetry {
 		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if time.Since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if time.Since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
@@ -160,7 +177,14 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffer(packet)
+	if len(endpoints) == 0 {
+		err = peer.SendBuffer(packet)
+	}
+	for _, endpoint := range endpoints {
+		if sendErr := peer.sendBufferTo(packet, endpoint); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}
 	if err != nil {
 		peer.device.log.Error.Println(peer, "- Failed to send handshake initiation", err)
 	}
@@ -219,7 +243,7 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	initiatingElem.bind.Send(writer.Bytes(), initiatingElem.endpoint)
 	return nil
 }
 
@@ -259,12 +283,12 @@ func (device *Device) RoutineReadFromTUN() {
 			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
 		}
-		elem = device.NewOutboundElement()
+		elem = device.NewOutboundElement(device.tunReadSize())
 
 		// read packet
 
 		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		size, err := device.tun.device.Read(elem.buffer, offset)
 
 		if err != nil {
 			if !device.isClosed.Get() {
@@ -280,6 +304,15 @@ func (device *Device) RoutineReadFromTUN() {
 			continue
 		}
 
+		// move small packets into a buffer of a smaller class
+
+		if needed := outboundBufferSize(size); device.messageBufferSize(needed) < len(elem.buffer) {
+			buffer := device.GetMessageBuffer(needed)
+			copy(buffer[offset:], elem.buffer[offset:offset+size])
+			device.PutMessageBuffer(elem.buffer)
+			elem.buffer = buffer
+		}
+
 		elem.packet = elem.buffer[offset : offset+size]
 
 		// lookup peer
@@ -311,6 +344,21 @@ func (device *Device) RoutineReadFromTUN() {
 		// insert into nonce/pre-handshake queue
 
 		if peer.isRunning.Get() {
+			if peer.quota.enabled.Get() && !peer.quotaAllows(PacketOutbound) {
+				continue
+			}
+			if filter := device.packetFilter(); filter != nil && !device.filterOutbound(filter, peer, elem) {
+				continue
+			}
+			if peer.shaping.tx.limited.Get() && !peer.shapeOutbound(elem) {
+				continue
+			}
+			if peer.conntrack.restricted.Get() {
+				peer.conntrackOutbound(elem.packet)
+			}
+			if device.capture.enabled.Get() {
+				device.capturePacket(peer, elem.packet, captureOutbound)
+			}
 			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
 				peer.SendHandshakeInitiation(false)
 			}
@@ -320,6 +368,17 @@ func (device *Device) RoutineReadFromTUN() {
 	}
 }
 
+/* Returns the amount of content a TUN read must have room for,
+ * which is bounded by the MTU when it is known
+ */
+func (device *Device) tunReadSize() int {
+	mtu := int(atomic.LoadInt32(&device.tun.mtu))
+	if mtu <= 0 || mtu > MaxContentSize {
+		return MaxContentSize
+	}
+	return mtu
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -353,6 +412,7 @@ func (peer *Peer) RoutineNonce() {
 
 	defer func() {
 		flush()
+		peer.FlushStagedQueue()
 		logDebug.Println(peer, "- Routine: nonce worker - stopped")
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 		peer.routines.stopping.Done()
@@ -379,6 +439,28 @@ func (peer *Peer) RoutineNonce() {
 				return
 			}
 
+			// wait out the delay imposed by the rate limit
+
+			if !elem.sendAfter.IsZero() {
+				timer := time.NewTimer(time.Until(elem.sendAfter))
+				select {
+				case <-timer.C:
+
+				case <-peer.signals.flushNonceQueue:
+					timer.Stop()
+					device.PutMessageBuffer(elem.buffer)
+					device.PutOutboundElement(elem)
+					flush()
+					goto NextPacket
+
+				case <-peer.routines.stop:
+					timer.Stop()
+					device.PutMessageBuffer(elem.buffer)
+					device.PutOutboundElement(elem)
+					return
+				}
+			}
+
 			// make sure to always pick the newest key
 
 			for {
@@ -442,8 +524,8 @@ func (peer *Peer) RoutineNonce() {
 			elem.dropped = AtomicFalse
 			elem.Lock()
 
-			// add to parallel and sequential queue
-			addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption, elem)
+			// add to sequential and staged queue
+			addToOutboundAndStagedQueues(peer, elem)
 		}
 	}
 }
@@ -500,20 +582,9 @@ func (device *Device) RoutineEncryption() {
 				continue
 			}
 
-			// populate header fields
-
-			header := elem.buffer[:MessageTransportHeaderSize]
-
-			fieldType := header[0:4]
-			fieldReceiver := header[4:8]
-			fieldNonce := header[8:16]
-
-			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
-			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
-			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
-
 			// pad content to multiple of 16
 
+			elem.keepalive = len(elem.packet) == 0
 			mtu := int(atomic.LoadInt32(&device.tun.mtu))
 			var paddedSize int
 			if mtu == 0 {
@@ -523,15 +594,43 @@ func (device *Device) RoutineEncryption() {
 				if lastUnit > mtu {
 					lastUnit %= mtu
 				}
-				paddedSize := (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
+				paddedSize = (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
 				if paddedSize > mtu {
 					paddedSize = mtu
 				}
 			}
+
+			// or to the MTU, hiding the size of the packet, padded keepalives are zeros for receivers to recognize
+
+			if mtu != 0 && len(elem.packet) <= mtu && (elem.chaff || elem.peer.privacy.padToMTU.Get()) {
+				atomic.AddUint64(&elem.peer.stats.txPadding, uint64(mtu-paddedSize))
+				paddedSize = mtu
+				size := len(elem.packet)
+				if needed := MessageTransportSize + paddedSize; needed > len(elem.buffer) {
+					buffer := device.GetMessageBuffer(needed)
+					copy(buffer[MessageTransportHeaderSize:], elem.packet)
+					device.PutMessageBuffer(elem.buffer)
+					elem.buffer = buffer
+				}
+				elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+			}
+
 			for i := len(elem.packet); i < paddedSize; i++ {
 				elem.packet = append(elem.packet, 0)
 			}
 
+			// populate header fields
+
+			header := elem.buffer[:MessageTransportHeaderSize]
+
+			fieldType := header[0:4]
+			fieldReceiver := header[4:8]
+			fieldNonce := header[8:16]
+
+			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
+			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
+
 			// encrypt content and release to consumer
 
 			binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
@@ -563,6 +662,7 @@ func (peer *Peer) RoutineSequentialSender() {
 			select {
 			case elem, ok := <-peer.queue.outbound:
 				if ok {
+					elem.Lock() // until encrypted or dropped from the staged queue
 					if !elem.IsDropped() {
 						device.PutMessageBuffer(elem.buffer)
 						elem.Drop()
@@ -606,8 +706,9 @@ func (peer *Peer) RoutineSequentialSender() {
 			// send message and return buffer to pool
 
 			err := peer.SendBuffer(elem.packet)
-			if len(elem.packet) != MessageKeepaliveSize {
+			if !elem.keepalive {
 				peer.timersDataSent()
+				peer.privacy.dataSent.Set(true)
 			}
 			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Per-peer traffic shaping with token buckets.
+ *
+ * Egress is charged in RoutineReadFromTUN before the packet enters the nonce queue,
+ * ingress in RoutineSequentialReceiver before the packet is written to the TUN device.
+ * Packets exceeding the rate are dropped, or when queuing is enabled,
+ * delayed in the routines of the peer for at most ShapingMaxQueueDelay.
+ */
+
+type tokenBucket struct {
+	sync.Mutex
+	limited AtomicBool // checked before taking the lock
+	rate    uint64     // bytes per second (0 = unlimited)
+	burst   uint64     // configured bucket size in bytes (0 = default)
+	size    float64    // effective bucket size in bytes
+	tokens  float64    // negative while packets are queued
+	last    time.Time  // last refill
+}
+
+func (bucket *tokenBucket) set(rate uint64, burst uint64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	bucket.rate = rate
+	bucket.burst = burst
+	bucket.size = float64(burst)
+	if burst == 0 {
+		bucket.size = float64(rate) * ShapingDefaultBurstTime.Seconds()
+		if bucket.size < ShapingMinBurst {
+			bucket.size = ShapingMinBurst
+		}
+	}
+	bucket.tokens = bucket.size
+	bucket.last = time.Now()
+	bucket.limited.Set(rate != 0)
+}
+
+func (bucket *tokenBucket) config() (rate uint64, burst uint64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	return bucket.rate, bucket.burst
+}
+
+/* Reserves tokens for n bytes, returning how long to wait before sending them,
+ * ok is false if the bytes cannot be sent within maxDelay
+ */
+func (bucket *tokenBucket) reserve(n int, now time.Time, maxDelay time.Duration) (delay time.Duration, ok bool) {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	if bucket.rate == 0 {
+		return 0, true
+	}
+
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * float64(bucket.rate)
+		if bucket.tokens > bucket.size {
+			bucket.tokens = bucket.size
+		}
+		bucket.last = now
+	}
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0, true
+	}
+	delay = time.Duration(-bucket.tokens / float64(bucket.rate) * float64(time.Second))
+	if delay > maxDelay {
+		bucket.tokens += float64(n)
+		return 0, false
+	}
+	return delay, true
+}
+
+/* Sets the rate limit of the peer in bytes per second (0 = unlimited)
+ * and the burst size in bytes (0 = default)
+ */
+func (peer *Peer) SetRateLimit(direction PacketDirection, rate uint64, burst uint64) {
+	if direction == PacketInbound {
+		peer.shaping.rx.set(rate, burst)
+	} else {
+		peer.shaping.tx.set(rate, burst)
+	}
+}
+
+/* Configures whether packets exceeding the rate limit are delayed rather than dropped
+ */
+func (peer *Peer) SetRateLimitQueuing(queue bool) {
+	peer.shaping.queue.Set(queue)
+}
+
+func (peer *Peer) shapingMaxDelay() time.Duration {
+	if peer.shaping.queue.Get() {
+		return ShapingMaxQueueDelay
+	}
+	return 0
+}
+
+/* Charges an outbound packet to the egress bucket,
+ * returns false if the packet should be dropped
+ */
+func (peer *Peer) shapeOutbound(elem *QueueOutboundElement) bool {
+	size := len(elem.packet)
+	now := time.Now()
+	delay, ok := peer.shaping.tx.reserve(size, now, peer.shapingMaxDelay())
+	if !ok || delay > 0 {
+		atomic.AddUint64(&peer.stats.txThrottled, uint64(size))
+	}
+	if delay > 0 {
+		elem.sendAfter = now.Add(delay)
+	}
+	return ok
+}
+
+/* Charges an inbound packet to the ingress bucket, waiting if queuing,
+ * returns false if the packet should be dropped
+ */
+func (peer *Peer) shapeInbound(elem *QueueInboundElement) bool {
+	size := len(elem.packet)
+	delay, ok := peer.shaping.rx.reserve(size, time.Now(), peer.shapingMaxDelay())
+	if !ok || delay > 0 {
+		atomic.AddUint64(&peer.stats.rxThrottled, uint64(size))
+	}
+	if !ok {
+		return false
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-peer.routines.stop:
+			return false
+		}
+	}
+	return true
+}
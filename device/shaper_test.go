@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var bucket tokenBucket
+
+	if delay, ok := bucket.reserve(1<<20, time.Now(), 0); !ok || delay != 0 {
+		t.Fatal("unlimited bucket throttled")
+	}
+
+	bucket.set(10000, 3000)
+	if !bucket.limited.Get() {
+		t.Fatal("bucket with rate not limited")
+	}
+	now := bucket.last
+
+	// drop mode: the burst passes, then packets are dropped until refilled
+
+	for i := 0; i < 3; i++ {
+		if _, ok := bucket.reserve(1000, now, 0); !ok {
+			t.Fatal("packet within burst dropped")
+		}
+	}
+	if _, ok := bucket.reserve(1000, now, 0); ok {
+		t.Fatal("packet exceeding burst passed")
+	}
+	now = now.Add(100 * time.Millisecond)
+	if _, ok := bucket.reserve(1000, now, 0); !ok {
+		t.Fatal("packet dropped after refill")
+	}
+
+	// refill is capped at the bucket size
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, ok := bucket.reserve(1000, now, 0); !ok {
+			t.Fatal("packet within burst dropped after idling")
+		}
+	}
+	if _, ok := bucket.reserve(1000, now, 0); ok {
+		t.Fatal("bucket overfilled while idling")
+	}
+
+	// queue mode: packets are delayed until the queue would exceed the maximum delay
+
+	delay, ok := bucket.reserve(1000, now, 250*time.Millisecond)
+	if !ok || delay != 100*time.Millisecond {
+		t.Fatal("unexpected delay of queued packet:", delay, ok)
+	}
+	delay, ok = bucket.reserve(1000, now, 250*time.Millisecond)
+	if !ok || delay != 200*time.Millisecond {
+		t.Fatal("unexpected delay of second queued packet:", delay, ok)
+	}
+	if _, ok = bucket.reserve(1000, now, 250*time.Millisecond); ok {
+		t.Fatal("packet queued beyond maximum delay")
+	}
+
+	bucket.set(0, 0)
+	if bucket.limited.Get() {
+		t.Fatal("bucket without rate limited")
+	}
+}
+
+func TestTokenBucketDefaultBurst(t *testing.T) {
+	var bucket tokenBucket
+	bucket.set(1e9, 0)
+	if bucket.size != 1e9*ShapingDefaultBurstTime.Seconds() {
+		t.Fatal("unexpected default burst:", bucket.size)
+	}
+	bucket.set(1, 0)
+	if bucket.size != ShapingMinBurst {
+		t.Fatal("default burst below a maximum sized message:", bucket.size)
+	}
+}
+
+func TestShapeOutbound(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelError, "")}
+	device.PopulatePools()
+	peer := &Peer{device: device}
+	peer.SetRateLimit(PacketOutbound, 1000, 1000)
+
+	elem := device.NewOutboundElement(1000)
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+1000]
+
+	if !peer.shapeOutbound(elem) || !elem.sendAfter.IsZero() {
+		t.Fatal("packet within burst throttled")
+	}
+	if peer.shapeOutbound(elem) {
+		t.Fatal("packet exceeding rate not dropped")
+	}
+	if peer.stats.txThrottled != 1000 {
+		t.Fatal("dropped bytes not counted:", peer.stats.txThrottled)
+	}
+
+	peer.SetRateLimit(PacketOutbound, 10000, 1000)
+	peer.SetRateLimitQueuing(true)
+	peer.shapeOutbound(elem)
+	if !peer.shapeOutbound(elem) || elem.sendAfter.IsZero() {
+		t.Fatal("packet exceeding rate not queued")
+	}
+	if peer.stats.txThrottled != 2000 {
+		t.Fatal("delayed bytes not counted:", peer.stats.txThrottled)
+	}
+}
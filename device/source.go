@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+)
+
+/* Explicit source address and egress interface of a peer, for multi-homed hosts.
+ *
+ * The pinned source overrides the source learned from received packets
+ * (and is not cleared on route changes), when supported by the endpoints of the platform.
+ */
+
+/* An Endpoint whose source can be pinned
+ */
+type pinnableEndpoint interface {
+	pinSrc(src4 net.IP, src6 net.IP, ifindex int32) // nil sources and zero index unpin
+}
+
+func sourcePinningSupported() bool {
+	_, ok := interface{}(new(NativeEndpoint)).(pinnableEndpoint)
+	return ok
+}
+
+/* Checks that the address is assigned to a local interface,
+ * or the interface if an index is given
+ */
+func validateSource(ip net.IP, ifindex int) error {
+	var addrs []net.Addr
+	var err error
+
+	if ifindex != 0 {
+		var iface *net.Interface
+		iface, err = net.InterfaceByIndex(ifindex)
+		if err != nil {
+			return errors.New("no interface with index")
+		}
+		if ip == nil {
+			return nil
+		}
+		addrs, err = iface.Addrs()
+	} else {
+		if ip == nil {
+			return nil
+		}
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return nil
+		}
+	}
+	if ifindex != 0 {
+		return errors.New("address not assigned to interface")
+	}
+	return errors.New("address not assigned to any interface")
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeUpdateSourcePin() {
+	source := &peer.source
+	source.pinned.Set(source.ip4 != nil || source.ip6 != nil || source.ifindex != 0)
+
+	// unpin endpoints immediately, pins are (re)applied when sending
+
+	if !source.pinned.Get() {
+		for _, endpoint := range append(peer.endpoints.candidates, peer.endpoint) {
+			if pinnable, ok := endpoint.(pinnableEndpoint); ok {
+				pinnable.pinSrc(nil, nil, 0)
+			}
+		}
+	}
+}
+
+/* Must hold peer.RWMutex
+ */
+func (peer *Peer) unsafeApplySourcePin(endpoint Endpoint) {
+	if pinnable, ok := endpoint.(pinnableEndpoint); ok {
+		pinnable.pinSrc(peer.source.ip4, peer.source.ip6, peer.source.ifindex)
+	}
+}
+
+/* Pins the source address of the peer for the address family of the ip
+ */
+func (peer *Peer) SetSourceAddress(ip net.IP) error {
+	if !sourcePinningSupported() {
+		return errors.New("source pinning not supported on this platform")
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if err := validateSource(ip, int(peer.source.ifindex)); err != nil {
+		return err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		peer.source.ip4 = ip4
+	} else {
+		peer.source.ip6 = ip.To16()
+	}
+	peer.unsafeUpdateSourcePin()
+	return nil
+}
+
+func (peer *Peer) ClearSourceAddresses() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.source.ip4 = nil
+	peer.source.ip6 = nil
+	peer.unsafeUpdateSourcePin()
+}
+
+/* Pins the egress interface of the peer, zero removes the pin
+ */
+func (peer *Peer) SetSourceInterface(ifindex int) error {
+	if ifindex != 0 && !sourcePinningSupported() {
+		return errors.New("source pinning not supported on this platform")
+	}
+	if ifindex < 0 || int(int32(ifindex)) != ifindex {
+		return errors.New("invalid interface index")
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if ifindex != 0 {
+		for _, ip := range []net.IP{peer.source.ip4, peer.source.ip6} {
+			if err := validateSource(ip, ifindex); err != nil {
+				return err
+			}
+		}
+	}
+	peer.source.ifindex = int32(ifindex)
+	peer.unsafeUpdateSourcePin()
+	return nil
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	assertNil(t, err)
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			return &ifaces[i]
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+func TestValidateSource(t *testing.T) {
+	loopback := loopbackInterface(t)
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	assertNil(t, validateSource(localhost, 0))
+	assertNil(t, validateSource(localhost, loopback.Index))
+	assertNil(t, validateSource(nil, loopback.Index))
+
+	if validateSource(net.IPv4(192, 0, 2, 1), 0) == nil {
+		t.Fatal("accepted address not assigned to any interface")
+	}
+	if validateSource(nil, 1<<30) == nil {
+		t.Fatal("accepted missing interface")
+	}
+}
+
+func TestSourcePin(t *testing.T) {
+	if !sourcePinningSupported() {
+		t.Skip("source pinning not supported on this platform")
+	}
+	loopback := loopbackInterface(t)
+
+	peer := &Peer{device: &Device{log: NewLogger(LogLevelError, "")}}
+
+	if peer.SetSourceAddress(net.IPv4(192, 0, 2, 1)) == nil {
+		t.Fatal("pinned address not assigned to any interface")
+	}
+	if peer.source.pinned.Get() {
+		t.Fatal("pinned after failed validation")
+	}
+
+	assertNil(t, peer.SetSourceAddress(net.IPv4(127, 0, 0, 1)))
+	assertNil(t, peer.SetSourceInterface(loopback.Index))
+	if !peer.source.pinned.Get() || !peer.source.ip4.Equal(net.IPv4(127, 0, 0, 1)) || peer.source.ip6 != nil {
+		t.Fatal("source not pinned")
+	}
+
+	peer.ClearSourceAddresses()
+	if !peer.source.pinned.Get() {
+		t.Fatal("interface pin removed with addresses")
+	}
+	assertNil(t, peer.SetSourceInterface(0))
+	if peer.source.pinned.Get() {
+		t.Fatal("source still pinned")
+	}
+}
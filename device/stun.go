@@ -0,0 +1,358 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+/* Discovery of the public address of the listening socket through STUN (RFC 5389).
+ *
+ * Binding requests are sent from the socket of the main bind to the configured servers,
+ * responses are demultiplexed from the WireGuard messages by their magic cookie and transaction id,
+ * only while requests are pending.
+ * Comparing the addresses mapped for different servers reveals the mapping behaviour of a NAT (RFC 5780).
+ */
+
+const (
+	stunHeaderSize            = 20
+	stunMagicCookie           = 0x2112A442
+	stunBindingRequest        = 0x0001
+	stunBindingResponse       = 0x0101
+	stunAttrMappedAddress     = 0x0001
+	stunAttrXorMappedAddress  = 0x0020
+	stunFamilyIPv4            = 0x01
+	stunFamilyIPv6            = 0x02
+	stunTransactionIDSize     = 12
+	stunTransactionIDOffset   = 8
+	stunMagicCookieOffset     = 4
+	stunMessageLengthOffset   = 2
+	stunAttributeHeaderLength = 4
+)
+
+type NATMapping int
+
+const (
+	NATMappingUnknown             NATMapping = iota // fewer than two servers answered
+	NATMappingNone                                  // the mapped address is local
+	NATMappingEndpointIndependent                   // same mapping for all servers
+	NATMappingEndpointDependent                     // mapping depends on the server (symmetric NAT)
+)
+
+func (mapping NATMapping) String() string {
+	switch mapping {
+	case NATMappingNone:
+		return "none"
+	case NATMappingEndpointIndependent:
+		return "endpoint-independent"
+	case NATMappingEndpointDependent:
+		return "endpoint-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+/* Outcome of a discovery
+ */
+type STUNResult struct {
+	Mapped  *net.UDPAddr // public address and port of the listening socket (nil = no server answered)
+	Mapping NATMapping
+}
+
+type stunRequest struct {
+	server   int      // index of the server in the discovery
+	endpoint Endpoint // the request was sent to
+}
+
+/* Checks if the datagram is a STUN message, rather than a WireGuard message
+ */
+func isSTUNMessage(packet []byte) bool {
+	return len(packet) >= stunHeaderSize &&
+		packet[0]&0xc0 == 0 &&
+		binary.BigEndian.Uint32(packet[stunMagicCookieOffset:]) == stunMagicCookie
+}
+
+/* Sets the STUN servers (host:port) and starts a discovery, an empty list stops discovering
+ */
+func (device *Device) SetSTUNServers(servers []string) {
+	device.stun.Lock()
+	device.stun.servers = append([]string(nil), servers...)
+	device.stun.Unlock()
+
+	device.DiscoverPublicEndpoint()
+}
+
+/* Sets the function called with the result of every discovery
+ */
+func (device *Device) SetSTUNHandler(handler func(STUNResult)) {
+	device.stun.Lock()
+	device.stun.handler = handler
+	device.stun.Unlock()
+}
+
+/* Returns the result of the last discovery
+ */
+func (device *Device) STUNResult() STUNResult {
+	device.stun.Lock()
+	defer device.stun.Unlock()
+	return device.stun.result
+}
+
+/* Starts discovering the public address, superseding a discovery in progress
+ */
+func (device *Device) DiscoverPublicEndpoint() {
+	device.stun.Lock()
+	device.stun.generation++
+	device.stun.pending = make(map[[stunTransactionIDSize]byte]stunRequest)
+	device.stun.awaiting.Set(false)
+	device.stun.mapped = make([]*net.UDPAddr, len(device.stun.servers))
+	servers := device.stun.servers
+	generation := device.stun.generation
+	if len(servers) == 0 {
+		device.stun.result = STUNResult{}
+	}
+	device.stun.Unlock()
+
+	if len(servers) > 0 && device.isUp.Get() {
+		go device.routineDiscoverPublicEndpoint(servers, generation)
+	}
+}
+
+func (device *Device) routineDiscoverPublicEndpoint(servers []string, generation uint64) {
+	logDebug := device.log.Debug
+	logError := device.log.Error
+
+	device.net.RLock()
+	transport := device.unsafeTransport()
+	device.net.RUnlock()
+	if transport != UDPTransport {
+		logError.Println("Failed to discover public endpoint: STUN requires the udp transport")
+		return
+	}
+
+	endpoints := make([]Endpoint, len(servers))
+	for i, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err == nil {
+			endpoints[i], err = device.CreateEndpoint(addr.String())
+		}
+		if err != nil {
+			logError.Println("Failed to resolve STUN server", server, ":", err)
+		}
+	}
+
+	for attempt := 0; attempt < STUNAttempts; attempt++ {
+		for i, endpoint := range endpoints {
+			if endpoint == nil {
+				continue
+			}
+			device.stun.Lock()
+			answered := device.stun.generation != generation || device.stun.mapped[i] != nil
+			device.stun.Unlock()
+			if answered {
+				continue
+			}
+			if err := device.sendSTUNRequest(endpoint, i, generation); err != nil {
+				logDebug.Println("Failed to send STUN request to", servers[i], ":", err)
+			}
+		}
+		time.Sleep(STUNRetransmitTimeout)
+
+		// stop once all servers answered
+
+		device.stun.Lock()
+		done := device.stun.generation != generation
+		if !done {
+			done = true
+			for i := range endpoints {
+				done = done && (endpoints[i] == nil || device.stun.mapped[i] != nil)
+			}
+		}
+		device.stun.Unlock()
+		if done {
+			break
+		}
+	}
+
+	device.stun.Lock()
+	if device.stun.generation != generation {
+		device.stun.Unlock()
+		return
+	}
+	device.stun.pending = nil
+	device.stun.awaiting.Set(false)
+	result := stunEvaluate(device.stun.mapped)
+	device.stun.result = result
+	handler := device.stun.handler
+	device.stun.Unlock()
+
+	if result.Mapped != nil {
+		device.log.Info.Println("Discovered public endpoint", result.Mapped, "behind", result.Mapping, "NAT mapping")
+	} else {
+		logError.Println("Failed to discover public endpoint, no STUN server answered")
+	}
+	if handler != nil {
+		handler(result)
+	}
+}
+
+/* Derives the NAT mapping behaviour from the addresses mapped by the servers
+ */
+func stunEvaluate(mapped []*net.UDPAddr) STUNResult {
+	var result STUNResult
+	answers := 0
+	for _, addr := range mapped {
+		if addr == nil {
+			continue
+		}
+		answers++
+		if result.Mapped == nil {
+			result.Mapped = addr
+			continue
+		}
+		if !addr.IP.Equal(result.Mapped.IP) || addr.Port != result.Mapped.Port {
+			result.Mapping = NATMappingEndpointDependent
+		}
+	}
+	if result.Mapped == nil || result.Mapping == NATMappingEndpointDependent {
+		return result
+	}
+	if validateSource(result.Mapped.IP, 0) == nil {
+		result.Mapping = NATMappingNone
+	} else if answers > 1 {
+		result.Mapping = NATMappingEndpointIndependent
+	}
+	return result
+}
+
+func (device *Device) sendSTUNRequest(endpoint Endpoint, server int, generation uint64) error {
+	var request [stunHeaderSize]byte
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[stunMagicCookieOffset:], stunMagicCookie)
+	if _, err := rand.Read(request[stunTransactionIDOffset:]); err != nil {
+		return err
+	}
+
+	var id [stunTransactionIDSize]byte
+	copy(id[:], request[stunTransactionIDOffset:])
+	device.stun.Lock()
+	if device.stun.generation != generation {
+		device.stun.Unlock()
+		return nil
+	}
+	device.stun.pending[id] = stunRequest{server: server, endpoint: endpoint}
+	device.stun.awaiting.Set(true)
+	device.stun.Unlock()
+
+	// bypass the obfuscation, servers expect plain STUN
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+
+	bind := device.net.bind
+	if obfuscated, ok := bind.(*obfuscatedBind); ok {
+		bind = obfuscated.Bind
+	}
+	if bind == nil {
+		return errors.New("no bind")
+	}
+	return bind.Send(request[:], endpoint)
+}
+
+/* Handles a datagram received on the listening socket while requests are pending,
+ * returning whether it was the response to one of them
+ */
+func (device *Device) receiveSTUN(packet []byte, endpoint Endpoint) bool {
+	if !isSTUNMessage(packet) || binary.BigEndian.Uint16(packet[0:]) != stunBindingResponse {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(packet[stunMessageLengthOffset:]))
+	if stunHeaderSize+size > len(packet) {
+		return false
+	}
+
+	var id [stunTransactionIDSize]byte
+	copy(id[:], packet[stunTransactionIDOffset:stunHeaderSize])
+
+	device.stun.Lock()
+	defer device.stun.Unlock()
+
+	request, ok := device.stun.pending[id]
+	if !ok || !bytes.Equal(request.endpoint.DstToBytes(), endpoint.DstToBytes()) {
+		return false
+	}
+	mapped := parseSTUNMappedAddress(packet[:stunHeaderSize+size])
+	if mapped == nil {
+		return false
+	}
+	delete(device.stun.pending, id)
+	device.stun.awaiting.Set(len(device.stun.pending) > 0)
+	device.stun.mapped[request.server] = mapped
+	return true
+}
+
+/* Returns the (XOR-)MAPPED-ADDRESS of a binding response, preferring the XOR variant
+ */
+func parseSTUNMappedAddress(packet []byte) *net.UDPAddr {
+	var mapped *net.UDPAddr
+	attributes := packet[stunHeaderSize:]
+	for len(attributes) >= stunAttributeHeaderLength {
+		typ := binary.BigEndian.Uint16(attributes[0:])
+		size := int(binary.BigEndian.Uint16(attributes[2:]))
+		if stunAttributeHeaderLength+size > len(attributes) {
+			return mapped
+		}
+		value := attributes[stunAttributeHeaderLength : stunAttributeHeaderLength+size]
+		switch typ {
+		case stunAttrXorMappedAddress:
+			if addr := parseSTUNAddress(value, packet[stunMagicCookieOffset:stunHeaderSize]); addr != nil {
+				return addr
+			}
+		case stunAttrMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+		padded := (size + 3) &^ 3
+		if stunAttributeHeaderLength+padded > len(attributes) {
+			return mapped
+		}
+		attributes = attributes[stunAttributeHeaderLength+padded:]
+	}
+	return mapped
+}
+
+/* Parses an address attribute, XORed with the magic cookie and transaction id if given
+ */
+func parseSTUNAddress(value []byte, xor []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	var ip net.IP
+	switch value[1] {
+	case stunFamilyIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case stunFamilyIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	if len(value) != 4+len(ip) {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	copy(ip, value[4:])
+	if xor != nil {
+		port ^= binary.BigEndian.Uint16(xor)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
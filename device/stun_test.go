@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Answers binding requests with the source address, its port shifted by offset
+ */
+func newTestSTUNServer(t *testing.T, offset int) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNil(t, err)
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			size, from, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			if size != stunHeaderSize || binary.BigEndian.Uint16(buff) != stunBindingRequest {
+				continue
+			}
+
+			response := make([]byte, stunHeaderSize+4+8)
+			binary.BigEndian.PutUint16(response[0:], stunBindingResponse)
+			binary.BigEndian.PutUint16(response[stunMessageLengthOffset:], 4+8)
+			copy(response[stunMagicCookieOffset:], buff[stunMagicCookieOffset:stunHeaderSize])
+			attribute := response[stunHeaderSize:]
+			binary.BigEndian.PutUint16(attribute[0:], stunAttrXorMappedAddress)
+			binary.BigEndian.PutUint16(attribute[2:], 8)
+			attribute[5] = stunFamilyIPv4
+			binary.BigEndian.PutUint16(attribute[6:], uint16(from.Port+offset)^(stunMagicCookie>>16))
+			binary.BigEndian.PutUint32(attribute[8:], binary.BigEndian.Uint32(from.IP.To4())^stunMagicCookie)
+			conn.WriteToUDP(response, from)
+		}
+	}()
+	return conn
+}
+
+func TestSTUNDiscovery(t *testing.T) {
+	server1 := newTestSTUNServer(t, 0)
+	defer server1.Close()
+	server2 := newTestSTUNServer(t, 0)
+	defer server2.Close()
+	server3 := newTestSTUNServer(t, 1)
+	defer server3.Close()
+
+	tun := NewChannelTUN()
+	dev := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	dev.Up()
+	defer dev.Close()
+
+	results := make(chan STUNResult, 1)
+	dev.SetSTUNHandler(func(result STUNResult) {
+		results <- result
+	})
+
+	discover := func(servers ...*net.UDPConn) STUNResult {
+		cfg := "private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58\nlisten_port=53561\nreplace_stun_servers=true\n"
+		for _, server := range servers {
+			cfg += "stun_server=" + server.LocalAddr().String() + "\n"
+		}
+		if err := dev.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("discovery did not complete")
+		}
+		return STUNResult{}
+	}
+
+	// the listening socket is not behind a NAT
+
+	result := discover(server1, server2)
+	if result.Mapped == nil || result.Mapped.String() != "127.0.0.1:53561" {
+		t.Fatal("unexpected mapped address", result.Mapped)
+	}
+	assertEquals(t, result.Mapping.String(), NATMappingNone.String())
+
+	var config strings.Builder
+	writer := bufio.NewWriter(&config)
+	if err := dev.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, line := range []string{
+		"stun_server=" + server1.LocalAddr().String() + "\n",
+		"stun_server=" + server2.LocalAddr().String() + "\n",
+		"stun_mapped_address=127.0.0.1:53561\n",
+		"stun_nat_mapping=none\n",
+	} {
+		if !strings.Contains(config.String(), line) {
+			t.Fatal("missing from configuration:", line)
+		}
+	}
+
+	// servers mapping different ports reveal an endpoint-dependent mapping
+
+	result = discover(server1, server3)
+	assertEquals(t, result.Mapping.String(), NATMappingEndpointDependent.String())
+
+	// a public address mapped alike by all servers reveals an endpoint-independent mapping
+
+	if stunEvaluate([]*net.UDPAddr{{IP: net.IPv4(192, 0, 2, 1), Port: 1}, {IP: net.IPv4(192, 0, 2, 1), Port: 1}}).Mapping != NATMappingEndpointIndependent {
+		t.Fatal("same public mapping not endpoint-independent")
+	}
+}
+
+func TestSTUNDemultiplexing(t *testing.T) {
+	device := &Device{}
+	endpoint, err := CreateEndpoint("192.0.2.1:3478")
+	assertNil(t, err)
+
+	// transport messages to the receiver index of the magic cookie pass without pending requests
+
+	packet := make([]byte, MessageTransportSize)
+	binary.LittleEndian.PutUint32(packet[0:], MessageTransportType)
+	binary.BigEndian.PutUint32(packet[stunMagicCookieOffset:], stunMagicCookie)
+	if device.stun.awaiting.Get() {
+		t.Fatal("awaiting STUN responses without requests")
+	}
+
+	// and while requests are pending, unless answering one of them
+
+	device.stun.pending = map[[stunTransactionIDSize]byte]stunRequest{{}: {endpoint: endpoint}}
+	device.stun.mapped = make([]*net.UDPAddr, 1)
+	device.stun.awaiting.Set(true)
+	if device.receiveSTUN(packet, endpoint) {
+		t.Fatal("transport message taken for STUN response")
+	}
+}
@@ -97,8 +97,13 @@ func expiredRetransmitHandshake(peer *Peer) {
 			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
 		}
 	} else {
-		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+		attempts := atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
+		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), attempts+1)
+
+		/* We move on to the next candidate endpoint, in case the current one is unreachable. */
+		if attempts%EndpointFailoverAttempts == 0 {
+			peer.failoverEndpoint()
+		}
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
@@ -125,25 +130,60 @@ func expiredNewHandshake(peer *Peer) {
 	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
+	endpoint := peer.endpoint
 	if peer.endpoint != nil {
 		peer.endpoint.ClearSrc()
 	}
 	peer.Unlock()
+	peer.keepaliveResponsesStopped(endpoint)
 	peer.SendHandshakeInitiation(false)
 
 }
 
+func expiredProbeEndpoint(peer *Peer) {
+	preferred, interval := peer.nextEndpointProbe()
+	if preferred == nil {
+		return
+	}
+
+	peer.device.log.Debug.Println(peer, "- Probing preferred endpoint", preferred.DstToString())
+	peer.sendHandshakeInitiation(true, RekeyTimeout, preferred)
+	if peer.timersActive() {
+		peer.timers.probeEndpoint.Mod(interval)
+	}
+}
+
 func expiredZeroKeyMaterial(peer *Peer) {
 	peer.device.log.Debug.Printf("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((RejectAfterTime * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval > 0 {
+	if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
+		peer.keepaliveIdle()
 		peer.SendKeepalive()
 	}
 }
 
+func expiredChaff(peer *Peer) {
+	interval := atomic.LoadInt64(&peer.privacy.chaffInterval)
+	if interval <= 0 {
+		return
+	}
+	if peer.timersActive() {
+		peer.timers.chaff.Mod(time.Duration(interval))
+	}
+
+	// data sent since the last slot takes the place of chaff
+
+	if peer.privacy.dataSent.Swap(false) {
+		return
+	}
+	if peer.queueKeepalive(true) {
+		atomic.AddUint64(&peer.stats.txChaff, 1)
+	}
+}
+
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
@@ -191,6 +231,7 @@ func (peer *Peer) timersHandshakeComplete() {
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	peer.punchCompleted()
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -202,8 +243,8 @@ func (peer *Peer) timersSessionDerived() {
 
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
-	if peer.persistentKeepaliveInterval > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(peer.persistentKeepaliveInterval) * time.Second)
+	if interval := atomic.LoadUint32(&peer.persistentKeepaliveInterval); interval > 0 && peer.timersActive() {
+		peer.timers.persistentKeepalive.Mod(time.Duration(interval) * time.Second)
 	}
 }
 
@@ -213,6 +254,9 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.probeEndpoint = peer.NewTimer(expiredProbeEndpoint)
+	peer.timers.chaff = peer.NewTimer(expiredChaff)
+	peer.timers.punch = peer.NewTimer(expiredPunch)
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	peer.timers.needAnotherKeepalive.Set(false)
@@ -224,4 +268,7 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.probeEndpoint.DelSync()
+	peer.timers.chaff.DelSync()
+	peer.timers.punch.DelSync()
 }
@@ -59,10 +59,74 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			send(fmt.Sprintf("listen_port=%d", device.net.port))
 		}
 
+		for _, port := range device.net.extraPorts {
+			send(fmt.Sprintf("additional_listen_port=%d", port))
+		}
+
 		if device.net.fwmark != 0 {
 			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
 		}
 
+		for _, ip := range []net.IP{device.net.listenAddr4, device.net.listenAddr6} {
+			if ip != nil {
+				send("listen_address=" + ip.String())
+			}
+		}
+
+		if device.net.bindInterface != "" {
+			send("bind_interface=" + device.net.bindInterface)
+		}
+
+		if transport := device.unsafeTransport(); transport != UDPTransport {
+			send("transport=" + transport.Name())
+		}
+
+		if device.net.obfuscationKey != (NoiseSymmetricKey{}) {
+			send("obfuscation_key=" + device.net.obfuscationKey.ToHex())
+		}
+
+		if device.net.obfuscationJunk != 0 {
+			send(fmt.Sprintf("obfuscation_junk_packets=%d", device.net.obfuscationJunk))
+		}
+
+		if device.net.rcvbuf != 0 {
+			send(fmt.Sprintf("socket_receive_buffer=%d", device.net.rcvbuf))
+		}
+
+		if device.net.sndbuf != 0 {
+			send(fmt.Sprintf("socket_send_buffer=%d", device.net.sndbuf))
+		}
+
+		if bufferSizingSupported() {
+			send(fmt.Sprintf("rx_socket_overflows=%d", device.unsafeSocketDrops()))
+		}
+
+		if server := device.relayServer(); server != nil {
+			send("relay_server=" + server.String())
+		}
+
+		device.stun.Lock()
+		for _, server := range device.stun.servers {
+			send("stun_server=" + server)
+		}
+		if device.stun.result.Mapped != nil {
+			send("stun_mapped_address=" + device.stun.result.Mapped.String())
+			send("stun_nat_mapping=" + device.stun.result.Mapping.String())
+		}
+		device.stun.Unlock()
+
+		device.capture.Lock()
+		if device.capture.file != nil {
+			send("capture_file=" + device.capture.path)
+		}
+		if device.capture.peer != nil {
+			send("capture_peer=" + device.capture.peer.ToHex())
+		}
+		if device.capture.maxSize != 0 {
+			send(fmt.Sprintf("capture_max_size=%d", device.capture.maxSize))
+		}
+		device.capture.Unlock()
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -75,6 +139,48 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			if peer.endpoint != nil {
 				send("endpoint=" + peer.endpoint.DstToString())
 			}
+			for _, ip := range []net.IP{peer.source.ip4, peer.source.ip6} {
+				if ip != nil {
+					send("source_address=" + ip.String())
+				}
+			}
+			if peer.source.ifindex != 0 {
+				send(fmt.Sprintf("source_interface=%d", peer.source.ifindex))
+			}
+			if mark := atomic.LoadUint32(&peer.fwmark); mark != 0 {
+				send(fmt.Sprintf("fwmark=%d", mark))
+			}
+			if peer.roaming.disabled {
+				send("disable_roaming=true")
+			}
+			for _, prefix := range peer.roaming.allowedIPs {
+				send("roaming_allowed_ip=" + prefix.String())
+			}
+			if rejected := atomic.LoadUint64(&peer.stats.roamingRejected); rejected != 0 || peer.roaming.restricted.Get() {
+				send(fmt.Sprintf("roaming_rejected=%d", rejected))
+			}
+			for _, endpoint := range peer.punch.candidates {
+				send("punch_candidate=" + endpoint.DstToString())
+			}
+			if peer.punch.active.Get() {
+				send("punching=true")
+			}
+			if fallbacks := peer.unsafeFallbackEndpoints(); len(fallbacks) > 0 {
+				if peer.endpoints.active != 0 {
+					send("preferred_endpoint=" + peer.unsafePreferredEndpoint().DstToString())
+				}
+				for _, endpoint := range fallbacks {
+					if _, ok := endpoint.(*RelayEndpoint); !ok {
+						send("fallback_endpoint=" + endpoint.DstToString())
+					}
+				}
+			}
+			if peer.endpoints.relayFallback {
+				send("relay_fallback=true")
+			}
+			if _, ok := peer.endpoint.(*RelayEndpoint); ok {
+				send("relayed=true")
+			}
 
 			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
 			secs := nano / time.Second.Nanoseconds()
@@ -84,7 +190,92 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
 			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
 			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			txFiltered := atomic.LoadUint64(&peer.stats.txFiltered)
+			rxFiltered := atomic.LoadUint64(&peer.stats.rxFiltered)
+			if txFiltered != 0 || rxFiltered != 0 || device.packetFilter() != nil {
+				send(fmt.Sprintf("tx_filtered_packets=%d", txFiltered))
+				send(fmt.Sprintf("rx_filtered_packets=%d", rxFiltered))
+			}
+
+			// the learned interval has its own key, setting the configuration again keeps learning
+
+			peer.keepalive.Lock()
+			if peer.keepalive.auto {
+				send("persistent_keepalive_interval=auto")
+				send(fmt.Sprintf("persistent_keepalive_learned_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval)))
+				if peer.keepalive.settled {
+					send("persistent_keepalive_settled=true")
+				}
+			} else {
+				send(fmt.Sprintf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval)))
+			}
+			peer.keepalive.Unlock()
+			peer.quota.Lock()
+			if peer.quota.enabled.Get() {
+				for _, quota := range []struct {
+					key     string
+					quota   *peerQuota
+					counter *uint64
+				}{{"tx", &peer.quota.tx, &peer.stats.txBytes}, {"rx", &peer.quota.rx, &peer.stats.rxBytes}} {
+					if quota.quota.limit == 0 {
+						continue
+					}
+					remaining := quota.quota.remaining(atomic.LoadUint64(quota.counter))
+					send(fmt.Sprintf("%s_quota=%d", quota.key, quota.quota.limit))
+					send(fmt.Sprintf("%s_quota_remaining=%d", quota.key, remaining))
+					if remaining == 0 {
+						send(quota.key + "_quota_exhausted=true")
+					}
+				}
+			}
+			if peer.quota.period != QuotaPeriodNone {
+				send("quota_period=" + peer.quota.period.String())
+				send(fmt.Sprintf("quota_reset_time_sec=%d", peer.quota.periodEnd.Unix()))
+			}
+			peer.quota.Unlock()
+
+			txRate, burst := peer.shaping.tx.config()
+			rxRate, _ := peer.shaping.rx.config()
+			txThrottled := atomic.LoadUint64(&peer.stats.txThrottled)
+			rxThrottled := atomic.LoadUint64(&peer.stats.rxThrottled)
+			if txRate != 0 {
+				send(fmt.Sprintf("tx_rate_limit=%d", txRate))
+			}
+			if rxRate != 0 {
+				send(fmt.Sprintf("rx_rate_limit=%d", rxRate))
+			}
+			if burst != 0 {
+				send(fmt.Sprintf("rate_limit_burst=%d", burst))
+			}
+			if peer.shaping.queue.Get() {
+				send("rate_limit_queue=true")
+			}
+			if txRate != 0 || txThrottled != 0 {
+				send(fmt.Sprintf("tx_throttled_bytes=%d", txThrottled))
+			}
+			if rxRate != 0 || rxThrottled != 0 {
+				send(fmt.Sprintf("rx_throttled_bytes=%d", rxThrottled))
+			}
+			padToMTU := peer.privacy.padToMTU.Get()
+			chaffInterval := time.Duration(atomic.LoadInt64(&peer.privacy.chaffInterval))
+			txPadding := atomic.LoadUint64(&peer.stats.txPadding)
+			txChaff := atomic.LoadUint64(&peer.stats.txChaff)
+			if padToMTU {
+				send("pad_to_mtu=true")
+			}
+			if padToMTU || txPadding != 0 {
+				send(fmt.Sprintf("tx_padding_bytes=%d", txPadding))
+			}
+			if chaffInterval != 0 {
+				send(fmt.Sprintf("chaff_interval_ms=%d", chaffInterval/time.Millisecond))
+			}
+			if chaffInterval != 0 || txChaff != 0 {
+				send(fmt.Sprintf("tx_chaff_packets=%d", txChaff))
+			}
+			if peer.conntrack.restricted.Get() {
+				send("restrict_inbound=true")
+				send(fmt.Sprintf("rx_rejected_packets=%d", atomic.LoadUint64(&peer.stats.rxRejected)))
+			}
 
 			for _, ip := range device.allowedips.EntriesForPeer(peer) {
 				send("allowed_ip=" + ip.String())
@@ -105,6 +296,36 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 	return nil
 }
 
+/* Dumps the connection tracking tables of the restricted peers, for debugging
+ */
+func (device *Device) IpcGetConntrackOperation(socket *bufio.Writer) *IPCError {
+	lines := make([]string, 0, 100)
+
+	func() {
+		device.peers.RLock()
+		defer device.peers.RUnlock()
+
+		for _, peer := range device.peers.keyMap {
+			if !peer.conntrack.restricted.Get() {
+				continue
+			}
+			lines = append(lines, "public_key="+peer.handshake.remoteStatic.ToHex())
+			for _, flow := range peer.conntrackDump() {
+				lines = append(lines, "flow="+flow)
+			}
+		}
+	}()
+
+	for _, line := range lines {
+		_, err := socket.WriteString(line + "\n")
+		if err != nil {
+			return &IPCError{ipc.IpcErrorIO}
+		}
+	}
+
+	return nil
+}
+
 func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 	scanner := bufio.NewScanner(socket)
 	logError := device.log.Error
@@ -169,6 +390,52 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 					return &IPCError{ipc.IpcErrorPortInUse}
 				}
 
+			case "replace_additional_listen_ports":
+
+				if value != "true" {
+					logError.Println("Failed to replace additional listen ports, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Removing all additional listen ports")
+
+				device.SetAdditionalListenPorts(nil)
+
+				if err := device.BindUpdate(); err != nil {
+					logError.Println("Failed to remove additional listen ports:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "additional_listen_port":
+
+				// listen on a further port, besides listen_port
+
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to parse additional_listen_port:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Adding additional listen port")
+
+				device.net.RLock()
+				ports := append([]uint16(nil), device.net.extraPorts...)
+				listenPort := device.net.port
+				device.net.RUnlock()
+
+				for _, existing := range append(ports, listenPort) {
+					if port != 0 && uint16(port) == existing {
+						logError.Println("Failed to add additional_listen_port, already listening:", port)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+				device.SetAdditionalListenPorts(append(ports, uint16(port)))
+
+				if err := device.BindUpdate(); err != nil {
+					logError.Println("Failed to set additional_listen_port:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
 			case "fwmark":
 
 				// parse fwmark field
@@ -193,6 +460,216 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 					return &IPCError{ipc.IpcErrorPortInUse}
 				}
 
+			case "listen_address":
+
+				// listen on a local address, an empty value listens on all addresses
+
+				var ip net.IP
+				if value != "" {
+					ip = net.ParseIP(value)
+					if ip == nil {
+						logError.Println("Failed to parse listen_address:", value)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating listen address")
+
+				if !bindRestrictionSupported {
+					logError.Println("Failed to set listen_address: not supported on this platform")
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if err := device.BindSetListenAddress(ip); err != nil {
+					logError.Println("Failed to set listen_address:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "bind_interface":
+
+				// bind the sockets to an interface, an empty value removes the restriction
+
+				if value != "" {
+					if _, err := net.InterfaceByName(value); err != nil {
+						logError.Println("Failed to set bind_interface:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating bind interface")
+
+				if !bindRestrictionSupported {
+					logError.Println("Failed to set bind_interface: not supported on this platform")
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if err := device.BindSetInterface(value); err != nil {
+					logError.Println("Failed to set bind_interface:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "socket_receive_buffer", "socket_send_buffer":
+
+				// size socket buffers in bytes
+
+				size, err := strconv.ParseUint(value, 10, 31)
+				if err != nil {
+					logError.Println("Failed to parse", key, ":", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating socket buffer size")
+
+				receive, send := int(size), 0
+				if key == "socket_send_buffer" {
+					receive, send = 0, int(size)
+				}
+				if err := device.BindSetBufferSizes(receive, send); err != nil {
+					logError.Println("Failed to set", key, ":", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "transport":
+
+				// exchange messages through another transport, converting the endpoints of all peers
+
+				transport, err := transportByName(value)
+				if err != nil {
+					logError.Println("Failed to set transport:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating transport")
+
+				if err := device.SetTransport(transport); err != nil {
+					logError.Println("Failed to set transport:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "obfuscation_key", "obfuscation_junk_packets":
+
+				// obfuscate messages on the wire, with a key shared by both ends
+
+				device.net.RLock()
+				obfuscationKey, junk := device.net.obfuscationKey, device.net.obfuscationJunk
+				device.net.RUnlock()
+
+				if key == "obfuscation_key" {
+					if err := obfuscationKey.FromHex(value); err != nil {
+						logError.Println("Failed to set obfuscation_key:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				} else {
+					count, err := strconv.ParseUint(value, 10, 8)
+					if err != nil || count > ObfuscationMaxJunkPackets {
+						logError.Println("Failed to parse obfuscation_junk_packets:", value)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+					junk = int(count)
+				}
+
+				logDebug.Println("UAPI: Updating obfuscation")
+
+				if err := device.SetObfuscation(obfuscationKey, junk); err != nil {
+					logError.Println("Failed to update obfuscation:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "replace_stun_servers":
+
+				if value != "true" {
+					logError.Println("Failed to replace STUN servers, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Removing all STUN servers")
+
+				device.SetSTUNServers(nil)
+
+			case "stun_server":
+
+				// discover the public address of the listening socket through the server
+
+				if _, _, err := net.SplitHostPort(value); err != nil {
+					logError.Println("Failed to parse stun_server:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Adding STUN server")
+
+				device.stun.Lock()
+				servers := append([]string(nil), device.stun.servers...)
+				device.stun.Unlock()
+
+				device.SetSTUNServers(append(servers, value))
+
+			case "relay_server":
+
+				// exchange messages with peers through the relay server, if direct connectivity fails
+
+				if value != "" {
+					if _, err := net.ResolveUDPAddr("udp", value); err != nil {
+						logError.Println("Failed to parse relay_server:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating relay server")
+
+				if err := device.SetRelayServer(value); err != nil {
+					logError.Println("Failed to update relay server:", err)
+					return &IPCError{ipc.IpcErrorPortInUse}
+				}
+
+			case "capture_file":
+
+				// start or stop capturing cleartext packets
+
+				if value == "" {
+					logDebug.Println("UAPI: Stopping packet capture")
+					device.StopCapture()
+					break
+				}
+
+				logDebug.Println("UAPI: Starting packet capture")
+
+				if err := device.StartCapture(value); err != nil {
+					logError.Println("Failed to start packet capture:", err)
+					return &IPCError{ipc.IpcErrorIO}
+				}
+
+			case "capture_peer":
+
+				// restrict capture to a single peer
+
+				if value == "" {
+					logDebug.Println("UAPI: Capturing packets of all peers")
+					device.SetCapturePeer(nil)
+					break
+				}
+
+				var publicKey NoisePublicKey
+				if err := publicKey.FromHex(value); err != nil {
+					logError.Println("Failed to set capture_peer:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating packet capture peer")
+				device.SetCapturePeer(&publicKey)
+
+			case "capture_max_size":
+
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					err = device.SetCaptureMaxSize(size)
+				}
+				if err != nil {
+					logError.Println("Failed to set capture_max_size:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating packet capture maximum size")
+
 			case "public_key":
 				// switch to peer configuration
 				logDebug.Println("UAPI: Transition to peer configuration")
@@ -304,13 +781,13 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				logDebug.Println(peer, "- UAPI: Updating endpoint")
 
 				err := func() error {
-					peer.Lock()
-					defer peer.Unlock()
-					endpoint, err := CreateEndpoint(value)
+					endpoint, err := device.CreateEndpoint(value)
 					if err != nil {
 						return err
 					}
-					peer.endpoint = endpoint
+					peer.Lock()
+					defer peer.Unlock()
+					peer.unsafeSetPreferredEndpoint(endpoint)
 					return nil
 				}()
 
@@ -319,28 +796,75 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
 
-			case "persistent_keepalive_interval":
+			case "fallback_endpoint":
 
-				// update persistent keepalive interval
+				// add candidate endpoint, used if the preceding ones are unreachable
 
-				logDebug.Println(peer, "- UAPI: Updating persistent keepalive interval")
+				logDebug.Println(peer, "- UAPI: Adding fallback endpoint")
+
+				err := func() error {
+					endpoint, err := device.CreateEndpoint(value)
+					if err != nil {
+						return err
+					}
+					peer.Lock()
+					defer peer.Unlock()
+					peer.unsafeAddFallbackEndpoint(endpoint)
+					return nil
+				}()
 
-				secs, err := strconv.ParseUint(value, 10, 16)
 				if err != nil {
-					logError.Println("Failed to set persistent keepalive interval:", err)
+					logError.Println("Failed to add fallback endpoint:", err, ":", value)
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
 
-				old := peer.persistentKeepaliveInterval
-				peer.persistentKeepaliveInterval = uint16(secs)
+			case "replace_fallback_endpoints":
 
-				// send immediate keepalive if we're turning it on and before it wasn't on
+				logDebug.Println(peer, "- UAPI: Removing all fallback endpoints")
 
-				if old == 0 && secs != 0 {
+				if value != "true" {
+					logError.Println("Failed to replace fallback endpoints, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.Lock()
+				peer.unsafeRemoveFallbackEndpoints()
+				peer.Unlock()
+
+			case "persistent_keepalive_interval":
+
+				// update persistent keepalive interval
+
+				logDebug.Println(peer, "- UAPI: Updating persistent keepalive interval")
+
+				old := atomic.LoadUint32(&peer.persistentKeepaliveInterval)
+				if value == "auto" {
+
+					// applying the configuration again keeps the learned interval
+
+					peer.keepalive.Lock()
+					auto := peer.keepalive.auto
+					peer.keepalive.Unlock()
+					if !auto {
+						peer.SetAutoKeepalive(true)
+					}
+				} else {
+					secs, err := strconv.ParseUint(value, 10, 16)
 					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{ipc.IpcErrorIO}
+						logError.Println("Failed to set persistent keepalive interval:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
 					}
+					peer.SetAutoKeepalive(false)
+					atomic.StoreUint32(&peer.persistentKeepaliveInterval, uint32(secs))
+				}
+
+				// send immediate keepalive if we're turning it on and before it wasn't on
+
+				if old == 0 && atomic.LoadUint32(&peer.persistentKeepaliveInterval) != 0 {
 					if device.isUp.Get() && !dummy {
 						peer.SendKeepalive()
 					}
@@ -378,6 +902,283 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) *IPCError {
 				ones, _ := network.Mask.Size()
 				device.allowedips.Insert(network.IP, uint(ones), peer)
 
+			case "restrict_inbound":
+
+				// only accept inbound packets of flows started from the TUN side
+
+				logDebug.Println(peer, "- UAPI: Updating inbound restriction")
+
+				restrict, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set inbound restriction, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetRestrictInbound(restrict)
+
+			case "tx_rate_limit", "rx_rate_limit":
+
+				// update rate limit in bytes per second
+
+				logDebug.Println(peer, "- UAPI: Updating rate limit")
+
+				rate, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set rate limit:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if key == "tx_rate_limit" {
+					_, burst := peer.shaping.tx.config()
+					peer.SetRateLimit(PacketOutbound, rate, burst)
+				} else {
+					_, burst := peer.shaping.rx.config()
+					peer.SetRateLimit(PacketInbound, rate, burst)
+				}
+
+			case "rate_limit_burst":
+
+				logDebug.Println(peer, "- UAPI: Updating rate limit burst")
+
+				burst, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set rate limit burst:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				txRate, _ := peer.shaping.tx.config()
+				rxRate, _ := peer.shaping.rx.config()
+				peer.SetRateLimit(PacketOutbound, txRate, burst)
+				peer.SetRateLimit(PacketInbound, rxRate, burst)
+
+			case "rate_limit_queue":
+
+				// delay rather than drop packets exceeding the rate limit
+
+				queue, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set rate limit queuing, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetRateLimitQueuing(queue)
+
+			case "tx_quota", "rx_quota":
+
+				// update quota in bytes per period
+
+				logDebug.Println(peer, "- UAPI: Updating quota")
+
+				limit, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set quota:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if key == "tx_quota" {
+					peer.SetQuota(PacketOutbound, limit)
+				} else {
+					peer.SetQuota(PacketInbound, limit)
+				}
+
+			case "quota_period":
+
+				logDebug.Println(peer, "- UAPI: Updating quota period")
+
+				period, err := ParseQuotaPeriod(value)
+				if err != nil {
+					logError.Println("Failed to set quota period:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetQuotaPeriod(period)
+
+			case "reset_quota":
+
+				if value != "true" {
+					logError.Println("Failed to reset quota, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println(peer, "- UAPI: Resetting quota")
+
+				peer.ResetQuota()
+
+			case "source_address":
+
+				// pin source address, an empty value removes the pinned addresses
+
+				logDebug.Println(peer, "- UAPI: Updating source address")
+
+				if value == "" {
+					peer.ClearSourceAddresses()
+					continue
+				}
+
+				ip := net.ParseIP(value)
+				if ip == nil {
+					logError.Println("Failed to set source address, invalid address:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				if err := peer.SetSourceAddress(ip); err != nil {
+					logError.Println("Failed to set source address:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "source_interface":
+
+				// pin egress interface, by index or name (0 removes the pin)
+
+				logDebug.Println(peer, "- UAPI: Updating source interface")
+
+				ifindex, err := strconv.ParseUint(value, 10, 31)
+				if err != nil {
+					iface, err := net.InterfaceByName(value)
+					if err != nil {
+						logError.Println("Failed to set source interface:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+					ifindex = uint64(iface.Index)
+				}
+				if err := peer.SetSourceInterface(int(ifindex)); err != nil {
+					logError.Println("Failed to set source interface:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "fwmark":
+
+				// mark datagrams to the peer, zero or an empty value uses the mark of the device
+
+				logDebug.Println(peer, "- UAPI: Updating fwmark")
+
+				mark, err := func() (uint32, error) {
+					if value == "" {
+						return 0, nil
+					}
+					mark, err := strconv.ParseUint(value, 10, 32)
+					return uint32(mark), err
+				}()
+
+				if err != nil {
+					logError.Println("Invalid fwmark", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if err := peer.SetFirewallMark(mark); err != nil {
+					logError.Println("Failed to set fwmark:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "disable_roaming":
+
+				// pin the endpoint of the peer
+
+				logDebug.Println(peer, "- UAPI: Updating roaming")
+
+				disabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set roaming, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetRoamingDisabled(disabled)
+
+			case "replace_roaming_allowed_ips":
+
+				logDebug.Println(peer, "- UAPI: Removing all roaming allowed ips")
+
+				if value != "true" {
+					logError.Println("Failed to replace roaming allowed ips, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetRoamingAllowedIPs(nil)
+
+			case "roaming_allowed_ip":
+
+				// restrict roaming to source addresses within the prefix
+
+				logDebug.Println(peer, "- UAPI: Adding roaming allowed ip")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to set roaming allowed ip:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.Lock()
+				peer.unsafeAddRoamingAllowedIP(*network)
+				peer.Unlock()
+
+			case "replace_punch_candidates":
+
+				logDebug.Println(peer, "- UAPI: Removing all punch candidates")
+
+				if value != "true" {
+					logError.Println("Failed to replace punch candidates, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetPunchCandidates(nil)
+
+			case "punch_candidate":
+
+				// punch a hole towards the candidate, along with the others
+
+				logDebug.Println(peer, "- UAPI: Adding punch candidate")
+
+				endpoint, err := device.CreateEndpoint(value)
+				if err != nil {
+					logError.Println("Failed to set punch candidate:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.AddPunchCandidate(endpoint)
+
+			case "relay_fallback":
+
+				// fall back to the relay server after the direct endpoints
+
+				logDebug.Println(peer, "- UAPI: Updating relay fallback")
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set relay_fallback, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetRelayFallback(enabled)
+
+			case "pad_to_mtu":
+
+				// hide the sizes of packets to the peer
+
+				logDebug.Println(peer, "- UAPI: Updating padding")
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set pad_to_mtu, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				peer.SetPadToMTU(enabled)
+
+			case "chaff_interval_ms":
+
+				// send chaff padded to the MTU in the intervals without data, zero disables chaff
+
+				logDebug.Println(peer, "- UAPI: Updating chaff interval")
+
+				interval, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to parse chaff_interval_ms:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+				if err := peer.SetChaffInterval(time.Duration(interval) * time.Millisecond); err != nil {
+					logError.Println("Failed to set chaff_interval_ms:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
 			case "protocol_version":
 
 				if value != "1" {
@@ -425,6 +1226,9 @@ func (device *Device) IpcHandle(socket net.Conn) {
 	case "get=1\n":
 		status = device.IpcGetOperation(buffered.Writer)
 
+	case "get=conntrack\n":
+		status = device.IpcGetConntrackOperation(buffered.Writer)
+
 	default:
 		device.log.Error.Println("Invalid UAPI operation:", op)
 		return
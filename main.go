@@ -29,6 +29,7 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_KEYLOG_FILE        = "WG_KEYLOG_FILE"
 )
 
 func printUsage() {
@@ -229,12 +230,38 @@ func main() {
 
 	logger.Info.Println("Device started")
 
+	// log session secrets for decrypting captures (debugging only)
+
+	var keyLog *os.File
+	if path := os.Getenv(ENV_WG_KEYLOG_FILE); path != "" {
+		keyLog, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Error.Println("Failed to open key log:", err)
+			os.Exit(ExitSetupFailed)
+		}
+		device.SetKeyLog(keyLog)
+	}
+
+	// the process exits through os.Exit as well, so the key log is closed explicitly
+
+	closeKeyLog := func() {
+		if keyLog == nil {
+			return
+		}
+		device.SetKeyLog(nil)
+		if err := keyLog.Sync(); err != nil {
+			logger.Error.Println("Failed to flush key log:", err)
+		}
+		keyLog.Close()
+	}
+
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
 
 	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
 	if err != nil {
 		logger.Error.Println("Failed to listen on uapi socket:", err)
+		closeKeyLog()
 		os.Exit(ExitSetupFailed)
 	}
 
@@ -266,6 +293,7 @@ func main() {
 
 	uapi.Close()
 	device.Close()
+	closeKeyLog()
 
 	logger.Info.Println("Shutting down")
 }
@@ -0,0 +1,252 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+)
+
+/* Relay of WireGuard messages between peers without direct connectivity.
+ *
+ * Clients register the public key of their device with the relay,
+ * then exchange datagrams addressed by the public key of the destination.
+ * The relay forwards them with the destination key replaced by the key of the source,
+ * it only ever sees the encrypted WireGuard messages.
+ *
+ * Clients prove to own their key when registering, much like MAC1 of WireGuard proves knowledge of a key:
+ * the relay answers a registration request with a challenge carrying its public key and a cookie
+ * bound to the address of the client, the client replies with a MAC keyed by the shared secret
+ * of its key and the key of the relay over the cookie, which only the owner of the key can compute.
+ * Requests are padded to the size of the challenge, for the relay not to amplify traffic.
+ */
+
+const (
+	MessageRegister  = 1 // [type][public key of the client][zero padding to ChallengeSize]
+	MessageData      = 2 // [type][public key of the destination (to relay) or source (from relay)][message]
+	MessageChallenge = 3 // [type][public key of the relay][cookie]
+	MessageProof     = 4 // [type][public key of the client][cookie][MAC]
+)
+
+const (
+	KeySize       = 32
+	CookieSize    = 16
+	MACSize       = 16
+	HeaderSize    = 1 + KeySize
+	ChallengeSize = HeaderSize + CookieSize
+	ProofSize     = HeaderSize + CookieSize + MACSize
+)
+
+const LabelProof = "relay-proof-----"
+
+const (
+	RegistrationTimeout = time.Second * 120 // registrations expire unless renewed
+	RegisterInterval    = time.Second * 25  // interval of renewals by clients, keeping NAT mappings open
+	MaxDatagramSize     = 65535
+)
+
+type Key [KeySize]byte
+
+type registration struct {
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+type Server struct {
+	conn       net.PacketConn
+	privateKey [KeySize]byte
+	publicKey  [KeySize]byte
+	secret     [blake2s.Size]byte // of cookies
+
+	sync.Mutex
+	clients   map[Key]*registration
+	addrs     map[string]Key // address of every registered client
+	collected time.Time
+}
+
+/* Creates a relay serving on the connection, with new keys
+ */
+func NewServer(conn net.PacketConn) *Server {
+	server := &Server{
+		conn:      conn,
+		clients:   make(map[Key]*registration),
+		addrs:     make(map[string]Key),
+		collected: time.Now(),
+	}
+	if _, err := rand.Read(server.privateKey[:]); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(server.secret[:]); err != nil {
+		panic(err)
+	}
+	server.privateKey[0] &= 248
+	server.privateKey[31] = (server.privateKey[31] & 127) | 64
+	curve25519.ScalarBaseMult(&server.publicKey, &server.privateKey)
+	return server
+}
+
+/* Returns the proof of the key of a client over the header and cookie of a proof message,
+ * from the shared secret of the client and the relay
+ */
+func ProofMAC(shared *[KeySize]byte, msg []byte) (mac [MACSize]byte) {
+	key := blake2s.Sum256(append([]byte(LabelProof), shared[:]...))
+	hash, _ := blake2s.New128(key[:])
+	hash.Write(msg[:HeaderSize+CookieSize])
+	hash.Sum(mac[:0])
+	return
+}
+
+/* Listens on the UDP address and serves until an error occurs
+ */
+func ListenAndServe(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return NewServer(conn).Serve()
+}
+
+/* Forwards datagrams until the connection is closed
+ */
+func (server *Server) Serve() error {
+	buff := make([]byte, MaxDatagramSize)
+	for {
+		size, addr, err := server.conn.ReadFrom(buff)
+		if err != nil {
+			return err
+		}
+		if size < HeaderSize {
+			continue
+		}
+
+		var key Key
+		copy(key[:], buff[1:HeaderSize])
+		switch buff[0] {
+		case MessageRegister:
+			if size >= ChallengeSize {
+				server.conn.WriteTo(server.challenge(addr, buff[:ChallengeSize]), addr)
+			}
+		case MessageProof:
+			if size >= ProofSize && server.verify(key, addr, buff[:ProofSize]) {
+				server.register(key, addr)
+			}
+		case MessageData:
+			dst := server.forward(key, addr, buff[1:HeaderSize])
+			if dst != nil {
+				server.conn.WriteTo(buff[:size], dst)
+			}
+		}
+	}
+}
+
+/* Returns the cookie of the address, changing every RegistrationTimeout
+ */
+func (server *Server) cookie(addr net.Addr, epoch int64) (cookie [CookieSize]byte) {
+	var buff [8]byte
+	binary.LittleEndian.PutUint64(buff[:], uint64(epoch))
+	hash, _ := blake2s.New128(server.secret[:])
+	hash.Write(buff[:])
+	hash.Write([]byte(addr.String()))
+	hash.Sum(cookie[:0])
+	return
+}
+
+func cookieEpoch(now time.Time) int64 {
+	return now.UnixNano() / int64(RegistrationTimeout)
+}
+
+/* Writes the challenge to the address into the buffer
+ */
+func (server *Server) challenge(addr net.Addr, buff []byte) []byte {
+	cookie := server.cookie(addr, cookieEpoch(time.Now()))
+	buff[0] = MessageChallenge
+	copy(buff[1:HeaderSize], server.publicKey[:])
+	copy(buff[HeaderSize:], cookie[:])
+	return buff
+}
+
+/* Verifies the proof of the key, with a cookie of the address of the current or last period
+ */
+func (server *Server) verify(key Key, addr net.Addr, msg []byte) bool {
+	epoch := cookieEpoch(time.Now())
+	cookie := msg[HeaderSize : HeaderSize+CookieSize]
+	current, last := server.cookie(addr, epoch), server.cookie(addr, epoch-1)
+	if subtle.ConstantTimeCompare(cookie, current[:]) != 1 && subtle.ConstantTimeCompare(cookie, last[:]) != 1 {
+		return false
+	}
+
+	var shared, zero [KeySize]byte
+	publicKey := [KeySize]byte(key)
+	curve25519.ScalarMult(&shared, &server.privateKey, &publicKey)
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return false
+	}
+	mac := ProofMAC(&shared, msg)
+	return subtle.ConstantTimeCompare(msg[HeaderSize+CookieSize:], mac[:]) == 1
+}
+
+func (server *Server) register(key Key, addr net.Addr) {
+	server.Lock()
+	defer server.Unlock()
+
+	now := time.Now()
+	server.unsafeCollect(now)
+
+	// a client address holds a single key, a key a single address
+
+	if old, ok := server.addrs[addr.String()]; ok && old != key {
+		delete(server.clients, old)
+	}
+	if client, ok := server.clients[key]; ok && client.addr.String() != addr.String() {
+		delete(server.addrs, client.addr.String())
+	}
+	server.clients[key] = &registration{addr: addr, lastSeen: now}
+	server.addrs[addr.String()] = key
+}
+
+/* Returns the address of the destination, replacing its key in the header by the key of the source
+ */
+func (server *Server) forward(dst Key, from net.Addr, header []byte) net.Addr {
+	server.Lock()
+	defer server.Unlock()
+
+	now := time.Now()
+	src, ok := server.addrs[from.String()]
+	if !ok || now.Sub(server.clients[src].lastSeen) > RegistrationTimeout {
+		return nil
+	}
+	client, ok := server.clients[dst]
+	if !ok || now.Sub(client.lastSeen) > RegistrationTimeout {
+		return nil
+	}
+	copy(header, src[:])
+	return client.addr
+}
+
+/* Removes expired registrations, at most once per timeout
+ *
+ * Must hold server.Mutex
+ */
+func (server *Server) unsafeCollect(now time.Time) {
+	if now.Sub(server.collected) < RegistrationTimeout {
+		return
+	}
+	server.collected = now
+	for key, client := range server.clients {
+		if now.Sub(client.lastSeen) > RegistrationTimeout {
+			delete(server.clients, key)
+			delete(server.addrs, client.addr.String())
+		}
+	}
+}
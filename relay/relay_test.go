@@ -0,0 +1,147 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+type testClient struct {
+	*net.UDPConn
+	privateKey [KeySize]byte
+	publicKey  Key
+}
+
+func TestRelay(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go NewServer(conn).Serve()
+
+	newClient := func(seed byte) *testClient {
+		conn, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &testClient{UDPConn: conn}
+		client.privateKey[1] = seed
+		publicKey := [KeySize]byte(client.publicKey)
+		curve25519.ScalarBaseMult(&publicKey, &client.privateKey)
+		client.publicKey = Key(publicKey)
+		return client
+	}
+	frame := func(typ byte, key Key, payload string) []byte {
+		buff := make([]byte, HeaderSize)
+		buff[0] = typ
+		copy(buff[1:], key[:])
+		return append(buff, payload...)
+	}
+	receive := func(client *testClient) []byte {
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buff := make([]byte, MaxDatagramSize)
+		size, err := client.Read(buff)
+		if err != nil {
+			return nil
+		}
+		return buff[:size]
+	}
+
+	// registering proves the key with the shared secret, claiming a key without it fails
+
+	register := func(client *testClient, privateKey [KeySize]byte, key Key) {
+		client.Write(frame(MessageRegister, key, string(make([]byte, CookieSize))))
+		challenge := receive(client)
+		if len(challenge) != ChallengeSize || challenge[0] != MessageChallenge {
+			t.Fatal("unexpected challenge", challenge)
+		}
+		var serverKey, shared [KeySize]byte
+		copy(serverKey[:], challenge[1:HeaderSize])
+		curve25519.ScalarMult(&shared, &privateKey, &serverKey)
+		proof := frame(MessageProof, key, string(challenge[HeaderSize:]))
+		mac := ProofMAC(&shared, proof)
+		client.Write(append(proof, mac[:]...))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	alice := newClient(1)
+	defer alice.Close()
+	bob := newClient(2)
+	defer bob.Close()
+	eve := newClient(3)
+	defer eve.Close()
+
+	register(alice, alice.privateKey, alice.publicKey)
+	register(bob, bob.privateKey, bob.publicKey)
+
+	// messages carry the key of the source
+
+	alice.Write(frame(MessageData, bob.publicKey, "ciphertext"))
+	if msg := receive(bob); !bytes.Equal(msg, frame(MessageData, alice.publicKey, "ciphertext")) {
+		t.Fatal("unexpected relayed message", msg)
+	}
+	bob.Write(frame(MessageData, alice.publicKey, "reply"))
+	if msg := receive(alice); !bytes.Equal(msg, frame(MessageData, bob.publicKey, "reply")) {
+		t.Fatal("unexpected relayed message", msg)
+	}
+
+	// unregistered sources and destinations are dropped
+
+	eve.Write(frame(MessageData, bob.publicKey, "spoofed"))
+	alice.Write(frame(MessageData, eve.publicKey, "lost"))
+	if msg := receive(bob); msg != nil {
+		t.Fatal("relayed message of unregistered source")
+	}
+
+	// keys cannot be claimed without proof, nor with the cookie of another address
+
+	register(eve, eve.privateKey, bob.publicKey)
+	alice.Write(frame(MessageData, bob.publicKey, "kept"))
+	if msg := receive(bob); !bytes.Equal(msg, frame(MessageData, alice.publicKey, "kept")) {
+		t.Fatal("registration claimed without proof", msg)
+	}
+
+	bob.Write(frame(MessageRegister, bob.publicKey, string(make([]byte, CookieSize))))
+	challenge := receive(bob)
+	var serverKey, shared [KeySize]byte
+	copy(serverKey[:], challenge[1:HeaderSize])
+	curve25519.ScalarMult(&shared, &bob.privateKey, &serverKey)
+	proof := frame(MessageProof, bob.publicKey, string(challenge[HeaderSize:]))
+	mac := ProofMAC(&shared, proof)
+	eve.Write(append(proof, mac[:]...))
+	time.Sleep(100 * time.Millisecond)
+	alice.Write(frame(MessageData, bob.publicKey, "kept"))
+	if msg := receive(bob); !bytes.Equal(msg, frame(MessageData, alice.publicKey, "kept")) {
+		t.Fatal("registration claimed with proof of another address", msg)
+	}
+
+	// registering from another address with proof moves the key
+
+	moved := newClient(2)
+	defer moved.Close()
+	register(moved, moved.privateKey, moved.publicKey)
+	alice.Write(frame(MessageData, bob.publicKey, "moved"))
+	if msg := receive(moved); !bytes.Equal(msg, frame(MessageData, alice.publicKey, "moved")) {
+		t.Fatal("message not relayed to new address", msg)
+	}
+	bob.Write(frame(MessageData, alice.publicKey, "stale"))
+	if msg := receive(alice); msg != nil {
+		t.Fatal("relayed message of stale address")
+	}
+
+	// short registration requests are not answered
+
+	eve.Write(frame(MessageRegister, eve.publicKey, ""))
+	if msg := receive(eve); msg != nil {
+		t.Fatal("challenge larger than request")
+	}
+}